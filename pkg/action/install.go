@@ -164,6 +164,11 @@ func (i *Install) installCRDs(crds []chart.CRD) error {
 		}
 		i.cfg.Log("Clearing discovery cache")
 		discoveryClient.Invalidate()
+		if kc, ok := i.cfg.KubeClient.(*kube.Client); ok {
+			if f, ok := kc.Factory.(*kube.CachedFactory); ok {
+				f.Invalidate()
+			}
+		}
 		// Give time for the CRD to be recognized.
 
 		if err := i.cfg.KubeClient.Wait(totalItems, 60*time.Second); err != nil {
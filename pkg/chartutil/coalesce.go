@@ -19,6 +19,7 @@ package chartutil
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/mitchellh/copystructure"
 	"github.com/pkg/errors"
@@ -43,6 +44,40 @@ func concatPrefix(a, b string) string {
 //	- A chart has access to all of the variables for it, as well as all of
 //		the values destined for its dependencies.
 func CoalesceValues(chrt *chart.Chart, vals map[string]interface{}) (Values, error) {
+	return coalesceWithSources(chrt, vals, valueSources{})
+}
+
+// The sources a value can be attributed to by CoalesceValuesWithProvenance.
+const (
+	// ProvenanceChart is a default from the values file of the chart the
+	// value belongs to.
+	ProvenanceChart = "chart"
+	// ProvenanceParent is an override from the values file of a parent chart.
+	ProvenanceParent = "parent"
+	// ProvenanceUser is a value supplied by the user.
+	ProvenanceUser = "user"
+)
+
+// CoalesceValuesWithProvenance is like CoalesceValues, but also returns the
+// source of every value, keyed by its dotted path, such as
+// "subchart.image.tag". Each source is one of ProvenanceChart,
+// ProvenanceParent or ProvenanceUser.
+//
+// Globals are copied from a parent chart into each of its subcharts, so only
+// the globals of the top-level chart and those set by a subchart's own values
+// file are listed.
+func CoalesceValuesWithProvenance(chrt *chart.Chart, vals map[string]interface{}) (Values, map[string]string, error) {
+	sources := valueSources{leaves: map[string]string{}, root: chrt.Metadata.Name + "."}
+	coalesced, err := coalesceWithSources(chrt, vals, sources)
+	if err != nil {
+		return coalesced, nil, err
+	}
+	prov := map[string]string{}
+	sources.collect(prov, "", coalesced)
+	return coalesced, prov, nil
+}
+
+func coalesceWithSources(chrt *chart.Chart, vals map[string]interface{}, sources valueSources) (Values, error) {
 	v, err := copystructure.Copy(vals)
 	if err != nil {
 		return vals, err
@@ -53,7 +88,68 @@ func CoalesceValues(chrt *chart.Chart, vals map[string]interface{}) (Values, err
 	if valsCopy == nil {
 		valsCopy = make(map[string]interface{})
 	}
-	return coalesce(log.Printf, chrt, valsCopy, "")
+	for key, val := range valsCopy {
+		sources.from(ProvenanceUser).add(sources.root+key, val)
+	}
+	return coalesce(log.Printf, chrt, valsCopy, "", sources)
+}
+
+// valueSources records the source of each value added while coalescing,
+// keyed by its dotted path. The zero value records nothing.
+type valueSources struct {
+	leaves map[string]string
+	// root prefixes the full keys of the values of the top-level chart, and
+	// is not part of the paths.
+	root string
+	// source is recorded for the values added.
+	source string
+}
+
+// from returns a copy of s that records values as coming from source.
+func (s valueSources) from(source string) valueSources {
+	s.source = source
+	return s
+}
+
+// add records the source of the leaves of val, which was added at fullkey.
+func (s valueSources) add(fullkey string, val interface{}) {
+	if s.leaves == nil {
+		return
+	}
+	if m, ok := val.(map[string]interface{}); ok && len(m) > 0 {
+		for k, v := range m {
+			s.add(fullkey+"."+k, v)
+		}
+		return
+	}
+	s.leaves[strings.TrimPrefix(fullkey, s.root)] = s.source
+}
+
+// collect copies the sources of the leaves of vals, which are at prefix, into
+// prov. Leaves without a recorded source, such as globals copied down into a
+// subchart, are left out.
+func (s valueSources) collect(prov map[string]string, prefix string, vals map[string]interface{}) {
+	for k, v := range vals {
+		path := concatPrefix(prefix, k)
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			s.collect(prov, path, m)
+			continue
+		}
+		if source, ok := s.leaves[path]; ok {
+			prov[path] = source
+		}
+	}
+}
+
+// sourceOf returns the source of the value of key in the values file of c: a
+// default of c itself, or an override for one of its subcharts.
+func sourceOf(c *chart.Chart, key string) string {
+	for _, dep := range c.Dependencies() {
+		if dep.Name() == key {
+			return ProvenanceParent
+		}
+	}
+	return ProvenanceChart
 }
 
 type printFn func(format string, v ...interface{})
@@ -61,13 +157,13 @@ type printFn func(format string, v ...interface{})
 // coalesce coalesces the dest values and the chart values, giving priority to the dest values.
 //
 // This is a helper function for CoalesceValues.
-func coalesce(printf printFn, ch *chart.Chart, dest map[string]interface{}, prefix string) (map[string]interface{}, error) {
-	coalesceValues(printf, ch, dest, prefix)
-	return coalesceDeps(printf, ch, dest, prefix)
+func coalesce(printf printFn, ch *chart.Chart, dest map[string]interface{}, prefix string, sources valueSources) (map[string]interface{}, error) {
+	coalesceValues(printf, ch, dest, prefix, sources)
+	return coalesceDeps(printf, ch, dest, prefix, sources)
 }
 
 // coalesceDeps coalesces the dependencies of the given chart.
-func coalesceDeps(printf printFn, chrt *chart.Chart, dest map[string]interface{}, prefix string) (map[string]interface{}, error) {
+func coalesceDeps(printf printFn, chrt *chart.Chart, dest map[string]interface{}, prefix string, sources valueSources) (map[string]interface{}, error) {
 	for _, subchart := range chrt.Dependencies() {
 		if c, ok := dest[subchart.Name()]; !ok {
 			// If dest doesn't already have the key, create it.
@@ -84,7 +180,7 @@ func coalesceDeps(printf printFn, chrt *chart.Chart, dest map[string]interface{}
 
 			// Now coalesce the rest of the values.
 			var err error
-			dest[subchart.Name()], err = coalesce(printf, subchart, dvmap, subPrefix)
+			dest[subchart.Name()], err = coalesce(printf, subchart, dvmap, subPrefix, sources)
 			if err != nil {
 				return dest, err
 			}
@@ -130,7 +226,7 @@ func coalesceGlobals(printf printFn, dest, src map[string]interface{}, prefix st
 					// Basically, we reverse order of coalesce here to merge
 					// top-down.
 					subPrefix := concatPrefix(prefix, key)
-					coalesceTablesFullKey(printf, vv, destvmap, subPrefix)
+					coalesceTablesFullKey(printf, vv, destvmap, subPrefix, valueSources{})
 					dg[key] = vv
 				}
 			}
@@ -156,7 +252,7 @@ func copyMap(src map[string]interface{}) map[string]interface{} {
 // coalesceValues builds up a values map for a particular chart.
 //
 // Values in v will override the values in the chart.
-func coalesceValues(printf printFn, c *chart.Chart, v map[string]interface{}, prefix string) {
+func coalesceValues(printf printFn, c *chart.Chart, v map[string]interface{}, prefix string, sources valueSources) {
 	subPrefix := concatPrefix(prefix, c.Metadata.Name)
 	for key, val := range c.Values {
 		if value, ok := v[key]; ok {
@@ -177,12 +273,13 @@ func coalesceValues(printf printFn, c *chart.Chart, v map[string]interface{}, pr
 				} else {
 					// Because v has higher precedence than nv, dest values override src
 					// values.
-					coalesceTablesFullKey(printf, dest, src, concatPrefix(subPrefix, key))
+					coalesceTablesFullKey(printf, dest, src, concatPrefix(subPrefix, key), sources.from(sourceOf(c, key)))
 				}
 			}
 		} else {
 			// If the key is not in v, copy it from nv.
 			v[key] = val
+			sources.from(sourceOf(c, key)).add(concatPrefix(subPrefix, key), val)
 		}
 	}
 }
@@ -191,13 +288,13 @@ func coalesceValues(printf printFn, c *chart.Chart, v map[string]interface{}, pr
 //
 // dest is considered authoritative.
 func CoalesceTables(dst, src map[string]interface{}) map[string]interface{} {
-	return coalesceTablesFullKey(log.Printf, dst, src, "")
+	return coalesceTablesFullKey(log.Printf, dst, src, "", valueSources{})
 }
 
 // coalesceTablesFullKey merges a source map into a destination map.
 //
 // dest is considered authoritative.
-func coalesceTablesFullKey(printf printFn, dst, src map[string]interface{}, prefix string) map[string]interface{} {
+func coalesceTablesFullKey(printf printFn, dst, src map[string]interface{}, prefix string, sources valueSources) map[string]interface{} {
 	// When --reuse-values is set but there are no modifications yet, return new values
 	if src == nil {
 		return dst
@@ -213,9 +310,10 @@ func coalesceTablesFullKey(printf printFn, dst, src map[string]interface{}, pref
 			delete(dst, key)
 		} else if !ok {
 			dst[key] = val
+			sources.add(fullkey, val)
 		} else if istable(val) {
 			if istable(dv) {
-				coalesceTablesFullKey(printf, dv.(map[string]interface{}), val.(map[string]interface{}), fullkey)
+				coalesceTablesFullKey(printf, dv.(map[string]interface{}), val.(map[string]interface{}), fullkey, sources)
 			} else {
 				printf("warning: cannot overwrite table with non table for %s (%v)", fullkey, val)
 			}
@@ -391,7 +391,7 @@ func TestCoalesceValuesWarnings(t *testing.T) {
 		warnings = append(warnings, fmt.Sprintf(format, v...))
 	}
 
-	_, err := coalesce(printf, c, vals, "")
+	_, err := coalesce(printf, c, vals, "", valueSources{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -403,6 +403,57 @@ func TestCoalesceValuesWarnings(t *testing.T) {
 
 }
 
+func TestCoalesceValuesWithProvenance(t *testing.T) {
+	grandchild := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "grandchild"},
+		Values:   map[string]interface{}{"port": 80, "debug": false},
+	}
+	child := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "child"},
+		Values: map[string]interface{}{
+			"image":      map[string]interface{}{"repository": "nginx", "tag": "1.0"},
+			"grandchild": map[string]interface{}{"port": 8080},
+		},
+	}
+	child.AddDependency(grandchild)
+	parent := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "parent"},
+		Values: map[string]interface{}{
+			"global": map[string]interface{}{"env": "dev"},
+			"child":  map[string]interface{}{"image": map[string]interface{}{"tag": "1.1"}},
+		},
+	}
+	parent.AddDependency(child)
+
+	// The user's values equal the defaults they override, and are still
+	// attributed to the user.
+	vals := map[string]interface{}{
+		"child": map[string]interface{}{
+			"image":      map[string]interface{}{"repository": "nginx"},
+			"grandchild": map[string]interface{}{"debug": false},
+		},
+	}
+
+	coalesced, prov, err := CoalesceValuesWithProvenance(parent, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"global.env":             ProvenanceChart,
+		"child.image.repository": ProvenanceUser,
+		"child.image.tag":        ProvenanceParent,
+		"child.grandchild.port":  ProvenanceParent,
+		"child.grandchild.debug": ProvenanceUser,
+	}, prov)
+
+	// The values are the same as without provenance.
+	expect, err := CoalesceValues(parent, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expect, coalesced)
+}
+
 func TestConcatPrefix(t *testing.T) {
 	assert.Equal(t, "b", concatPrefix("", "b"))
 	assert.Equal(t, "a.b", concatPrefix("a", "b"))
@@ -17,7 +17,11 @@ limitations under the License.
 package engine
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"path"
 	"path/filepath"
@@ -26,11 +30,15 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/Masterminds/sprig/v3"
 	"github.com/pkg/errors"
+	yamlv3 "gopkg.in/yaml.v3"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
 
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/releaseutil"
 )
 
 // Engine is an implementation of the Helm rendering implementation for templates.
@@ -40,8 +48,49 @@ type Engine struct {
 	Strict bool
 	// In LintMode, some 'required' template values may be missing, so don't fail
 	LintMode bool
+	// CollectErrors renders every template even after one has failed, and
+	// returns a RenderErrors listing all of the failures. By default rendering
+	// stops at the first error.
+	CollectErrors bool
+	// Validators are called with the kind and content of every document
+	// produced by Render. If any of them returns an error, the render fails.
+	Validators []func(kind string, doc string) error
+	// CustomTemplateFuncs are added to the functions available to templates,
+	// replacing any built-in function of the same name. The late-bound
+	// functions, such as include and tpl, cannot be replaced.
+	CustomTemplateFuncs template.FuncMap
+	// EnableDNS enables the getHostByName function, which performs a DNS
+	// lookup. It is disabled by default so that rendering is deterministic.
+	EnableDNS bool
+	// CanonicalOutput re-encodes every YAML document produced by Render with
+	// its keys sorted, so that the output is stable byte for byte. Comments
+	// and the style of block scalars are not preserved.
+	CanonicalOutput bool
+	// Flags are feature flags set by the application embedding Helm, which
+	// templates read with the flag function. Flags that are not set are off.
+	Flags map[string]bool
+	// MaxOutputBytes limits the total size of the output of Render, and
+	// MaxDocuments the total number of YAML documents in it. Rendering stops
+	// with an error as soon as either limit is exceeded, such as by a range
+	// over a much larger list than expected. Zero means no limit.
+	MaxOutputBytes int64
+	MaxDocuments   int
+	// Delims are the left and right action delimiters of the templates, such
+	// as "[[" and "]]" for templates with content for another tool that uses
+	// "{{" and "}}". TemplateDelims sets the delimiters of individual
+	// templates by name, such as "mychart/templates/rules.yaml", instead. The
+	// default is "{{" and "}}".
+	Delims         [2]string
+	TemplateDelims map[string][2]string
 	// the rest config to connect to the kubernetes api
 	config *rest.Config
+	// the context that cancels the render, if any
+	ctx context.Context
+	// the limits of the output of the current render
+	limits *outputLimits
+	// whether referenced templates that fail to parse are left out, instead
+	// of failing the render
+	skipBrokenReferences bool
 }
 
 // Render takes a chart, optional values, and value overrides, and attempts to render the Go templates.
@@ -64,8 +113,90 @@ type Engine struct {
 // section contains a value named "bar", that value will be passed on to the
 // bar chart during render time.
 func (e Engine) Render(chrt *chart.Chart, values chartutil.Values) (map[string]string, error) {
+	return e.RenderWithContext(context.Background(), chrt, values)
+}
+
+// RenderWithContext is like Render, but stops rendering when ctx is cancelled.
+// Cancellation is checked before each template is rendered, and the error of
+// ctx is returned once it is done.
+func (e Engine) RenderWithContext(ctx context.Context, chrt *chart.Chart, values chartutil.Values) (map[string]string, error) {
 	tmap := allTemplates(chrt, values)
-	return e.render(tmap)
+	rendered, err := e.withContext(ctx).render(tmap)
+	if err != nil {
+		return rendered, err
+	}
+	if e.CanonicalOutput {
+		canonicalize(rendered)
+	}
+	if err := e.validate(rendered); err != nil {
+		return map[string]string{}, err
+	}
+	return rendered, nil
+}
+
+// RenderOne renders only the template templateName, such as
+// "mychart/templates/service.yaml", and returns its output, to debug one
+// template of a large chart. The name can also be relative to the chart, such
+// as "templates/service.yaml".
+//
+// The other templates of the chart and its dependencies are not rendered, but
+// the templates they define can be used with include and template. Those that
+// fail to parse are left out, so that they only cause an error if templateName
+// uses one of their definitions.
+func (e Engine) RenderOne(chrt *chart.Chart, values chartutil.Values, templateName string) (string, error) {
+	tmap := allTemplates(chrt, values)
+	filename := templateName
+	if _, ok := tmap[filename]; !ok {
+		filename = path.Join(chrt.ChartFullPath(), templateName)
+	}
+	tpl, ok := tmap[filename]
+	if !ok {
+		return "", errors.Errorf("template %s not found in chart %s", templateName, chrt.Name())
+	}
+	if strings.HasPrefix(path.Base(filename), "_") {
+		return "", errors.Errorf("template %s is a partial and has no output of its own", templateName)
+	}
+
+	one := e
+	one.skipBrokenReferences = true
+	rendered, err := one.renderWithReferences(map[string]renderable{filename: tpl}, tmap)
+	if err != nil {
+		return "", err
+	}
+	if e.CanonicalOutput {
+		canonicalize(rendered)
+	}
+	if err := e.validate(rendered); err != nil {
+		return "", err
+	}
+	return rendered[filename], nil
+}
+
+// RenderLayers renders the chart and returns the gzipped output of each
+// template. The keys are the same as those returned by Render: the template
+// path prefixed with the chart's full path, such as "mychart/templates/a.yaml"
+// or "mychart/charts/sub/templates/b.yaml". Partials are not included.
+//
+// The result is suitable for pushing each rendered template as a separate OCI
+// layer.
+func (e Engine) RenderLayers(chrt *chart.Chart, values chartutil.Values) (map[string][]byte, error) {
+	rendered, err := e.Render(chrt, values)
+	if err != nil {
+		return nil, err
+	}
+	layers := make(map[string][]byte, len(rendered))
+	for name, content := range rendered {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(content)); err != nil {
+			return nil, errors.Wrapf(err, "unable to compress %s", name)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, errors.Wrapf(err, "unable to compress %s", name)
+		}
+		layers[name] = buf.Bytes()
+	}
+	return layers, nil
 }
 
 // Render takes a chart, optional values, and value overrides, and attempts to
@@ -91,8 +222,12 @@ type renderable struct {
 	vals chartutil.Values
 	// namespace prefix to the templates of the current chart
 	basePath string
+	// parentVals are the values of the parent chart, if there is one.
+	parentVals chartutil.Values
 }
 
+const notesFileSuffix = "NOTES.txt"
+
 const warnStartDelim = "HELM_ERR_START"
 const warnEndDelim = "HELM_ERR_END"
 const recursionMaxNums = 1000
@@ -106,6 +241,11 @@ func warnWrap(warn string) string {
 // initFunMap creates the Engine's FuncMap and adds context-specific functions.
 func (e Engine) initFunMap(t *template.Template, referenceTpls map[string]renderable) {
 	funcMap := funcMap()
+	// Custom functions may deliberately replace built-in ones, but not the
+	// late-bound functions set below, which templates depend on.
+	for k, v := range e.CustomTemplateFuncs {
+		funcMap[k] = v
+	}
 	includedNames := make(map[string]int)
 
 	// Add the 'include' function here so we can close over t.
@@ -119,12 +259,18 @@ func (e Engine) initFunMap(t *template.Template, referenceTpls map[string]render
 		} else {
 			includedNames[name] = 1
 		}
-		err := t.ExecuteTemplate(&buf, name, data)
+		err := t.ExecuteTemplate(e.limits.nested().writer(&buf, name), name, data)
 		includedNames[name]--
 		return buf.String(), err
 	}
 
-	// Add the 'tpl' function here
+	// Add the 'tpl' function here. Charts often pass the same snippet to tpl
+	// many times, such as in a loop, so the parsed snippets are kept for the
+	// rest of the render. The name of the calling template is part of the
+	// key because it decides which chart, and so which parent values, the
+	// snippet renders for.
+	type tplCacheKey struct{ name, tpl string }
+	tplCache := make(map[tplCacheKey]*template.Template)
 	funcMap["tpl"] = func(tpl string, vals chartutil.Values) (string, error) {
 		basePath, err := vals.PathValue("Template.BasePath")
 		if err != nil {
@@ -136,19 +282,50 @@ func (e Engine) initFunMap(t *template.Template, referenceTpls map[string]render
 			return "", errors.Wrapf(err, "cannot retrieve Template.Name from values inside tpl function: %s", tpl)
 		}
 
+		name := templateName.(string)
 		templates := map[string]renderable{
-			templateName.(string): {
+			name: {
 				tpl:      tpl,
 				vals:     vals,
 				basePath: basePath.(string),
+				// parentValue in the snippet reads the same parent values as
+				// the template that called tpl.
+				parentVals: referenceTpls[name].parentVals,
 			},
 		}
 
-		result, err := e.renderWithReferences(templates, referenceTpls)
+		key := tplCacheKey{name: name, tpl: tpl}
+		parsed, ok := tplCache[key]
+		if !ok {
+			// Snippets usually come from values, so they are parsed with the
+			// delimiters of the render rather than those of the calling
+			// template, which are kept for the templates it references.
+			snippet := e
+			if _, ok := e.TemplateDelims[name]; ok {
+				snippet.TemplateDelims = make(map[string][2]string, len(e.TemplateDelims))
+				for k, v := range e.TemplateDelims {
+					if k != name {
+						snippet.TemplateDelims[k] = v
+					}
+				}
+			}
+			var errs RenderErrors
+			parsed, _, errs, err = snippet.parseTemplates(templates, referenceTpls)
+			if err == nil && len(errs) > 0 {
+				err = errs
+			}
+			if err != nil {
+				return "", errors.Wrapf(err, "error during tpl function execution for %q", tpl)
+			}
+			tplCache[key] = parsed
+		}
+		inner := e
+		inner.limits = e.limits.nested()
+		result, err := inner.executeTemplates(parsed, templates, nil, nil)
 		if err != nil {
 			return "", errors.Wrapf(err, "error during tpl function execution for %q", tpl)
 		}
-		return result[templateName.(string)], nil
+		return result[name], nil
 	}
 
 	// Add the `required` function here so we can use lintMode
@@ -183,15 +360,31 @@ func (e Engine) initFunMap(t *template.Template, referenceTpls map[string]render
 		return "", errors.New(warnWrap(msg))
 	}
 
+	funcMap["flag"] = func(name string) bool {
+		return e.Flags[name]
+	}
+
+	if e.EnableDNS {
+		funcMap["getHostByName"] = sprig.TxtFuncMap()["getHostByName"]
+	}
+
 	// If we are not linting and have a cluster connection, provide a Kubernetes-backed
 	// implementation.
 	if !e.LintMode && e.config != nil {
 		funcMap["lookup"] = NewLookupFunction(e.config)
+		funcMap["lookupList"] = newLookupListFunction(e.config)
+		funcMap["lookupWithSelector"] = newLookupWithSelectorFunction(e.config)
 	}
 
 	t.Funcs(funcMap)
 }
 
+// withContext returns a copy of e that stops rendering when ctx is done.
+func (e Engine) withContext(ctx context.Context) Engine {
+	e.ctx = ctx
+	return e
+}
+
 // render takes a map of templates/values and renders them.
 func (e Engine) render(tpls map[string]renderable) (map[string]string, error) {
 	return e.renderWithReferences(tpls, tpls)
@@ -212,7 +405,20 @@ func (e Engine) renderWithReferences(tpls, referenceTpls map[string]renderable)
 			err = errors.Errorf("rendering template failed: %v", r)
 		}
 	}()
-	t := template.New("gotpl")
+	e.limits = &outputLimits{maxBytes: e.MaxOutputBytes, maxDocuments: e.MaxDocuments}
+	t, failed, errs, err := e.parseTemplates(tpls, referenceTpls)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return e.executeTemplates(t, tpls, failed, errs)
+}
+
+// parseTemplates parses tpls, along with the templates of referenceTpls they
+// can reference, into a single template. With CollectErrors, parse errors in
+// tpls are returned in errs and the templates are marked as failed, instead of
+// ending the parse.
+func (e Engine) parseTemplates(tpls, referenceTpls map[string]renderable) (t *template.Template, failed map[string]bool, errs RenderErrors, err error) {
+	t = template.New("gotpl").Delims(e.Delims[0], e.Delims[1])
 	if e.Strict {
 		t.Option("missingkey=error")
 	} else {
@@ -228,37 +434,79 @@ func (e Engine) renderWithReferences(tpls, referenceTpls map[string]renderable)
 	keys := sortTemplates(tpls)
 	referenceKeys := sortTemplates(referenceTpls)
 
+	failed = make(map[string]bool)
 	for _, filename := range keys {
 		r := tpls[filename]
-		if _, err := t.New(filename).Parse(r.tpl); err != nil {
-			return map[string]string{}, cleanupParseError(filename, err)
+		if _, err := t.New(filename).Delims(e.delims(filename)).Parse(r.tpl); err != nil {
+			err = cleanupParseError(filename, err)
+			if !e.CollectErrors {
+				return nil, nil, nil, err
+			}
+			errs = append(errs, err)
+			failed[filename] = true
 		}
 	}
 
 	// Adding the reference templates to the template context
 	// so they can be referenced in the tpl function
 	for _, filename := range referenceKeys {
-		if t.Lookup(filename) == nil {
+		if t.Lookup(filename) == nil && !failed[filename] {
 			r := referenceTpls[filename]
-			if _, err := t.New(filename).Parse(r.tpl); err != nil {
-				return map[string]string{}, cleanupParseError(filename, err)
+			if _, err := t.New(filename).Delims(e.delims(filename)).Parse(r.tpl); err != nil {
+				if e.skipBrokenReferences {
+					continue
+				}
+				return nil, nil, nil, cleanupParseError(filename, err)
 			}
 		}
 	}
+	return t, failed, errs, nil
+}
 
-	rendered = make(map[string]string, len(keys))
+// delims returns the action delimiters of the template filename.
+func (e Engine) delims(filename string) (string, string) {
+	if d, ok := e.TemplateDelims[filename]; ok {
+		return d[0], d[1]
+	}
+	return e.Delims[0], e.Delims[1]
+}
+
+// executeTemplates renders the templates of tpls that were parsed into t by
+// parseTemplates, skipping partials and the templates that failed to parse.
+func (e Engine) executeTemplates(t *template.Template, tpls map[string]renderable, failed map[string]bool, errs RenderErrors) (map[string]string, error) {
+	keys := sortTemplates(tpls)
+	rendered := make(map[string]string, len(keys))
 	for _, filename := range keys {
+		if e.ctx != nil {
+			if err := e.ctx.Err(); err != nil {
+				return map[string]string{}, err
+			}
+		}
 		// Don't render partials. We don't care out the direct output of partials.
 		// They are only included from other templates.
-		if strings.HasPrefix(path.Base(filename), "_") {
+		if strings.HasPrefix(path.Base(filename), "_") || failed[filename] {
 			continue
 		}
 		// At render time, add information about the template that is being rendered.
 		vals := tpls[filename].vals
 		vals["Template"] = chartutil.Values{"Name": filename, "BasePath": tpls[filename].basePath}
+		// Bind parentValue to the values of the parent of the chart that
+		// owns this template.
+		parentVals := tpls[filename].parentVals
+		t.Funcs(template.FuncMap{"parentValue": func(path string) interface{} {
+			return valueAt(parentVals, path)
+		}})
 		var buf strings.Builder
-		if err := t.ExecuteTemplate(&buf, filename, vals); err != nil {
-			return map[string]string{}, cleanupExecError(filename, err)
+		if err := t.ExecuteTemplate(e.limits.writer(&buf, filename), filename, vals); err != nil {
+			err = cleanupExecError(filename, err)
+			// An exceeded limit ends the render, even when it's wrapped in
+			// the error of an include or tpl.
+			var limitErr outputLimitError
+			if errors.As(err, &limitErr) || !e.CollectErrors {
+				return map[string]string{}, err
+			}
+			errs = append(errs, err)
+			continue
 		}
 
 		// Work around the issue where Go will emit "<no value>" even if Options(missing=zero)
@@ -267,9 +515,251 @@ func (e Engine) renderWithReferences(tpls, referenceTpls map[string]renderable)
 		rendered[filename] = strings.ReplaceAll(buf.String(), "<no value>", "")
 	}
 
+	if len(errs) > 0 {
+		return map[string]string{}, errs
+	}
 	return rendered, nil
 }
 
+// RenderErrors is returned by Render when CollectErrors is set and one or more
+// templates failed to render. Each error names the template and the line it
+// occurred at.
+type RenderErrors []error
+
+func (e RenderErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d templates failed to render:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// outputLimits enforces the MaxOutputBytes and MaxDocuments limits of an
+// Engine across all of the templates of a render.
+type outputLimits struct {
+	maxBytes     int64
+	maxDocuments int
+	bytes        int64
+	documents    int
+	// parent is set for nested limits, whose output is only counted towards
+	// parent once it is written to the output of a template.
+	parent *outputLimits
+}
+
+// nested returns the limits for output that is built up in memory before it
+// is written to the output of a template, such as that of include and tpl.
+// The output fails as soon as it alone would exceed what is left of l,
+// rather than after all of it has been built up.
+func (l *outputLimits) nested() *outputLimits {
+	return &outputLimits{maxBytes: l.maxBytes, maxDocuments: l.maxDocuments, parent: l}
+}
+
+// used returns the bytes and documents counted so far by l and its parents.
+func (l *outputLimits) used() (bytes int64, documents int) {
+	for ; l != nil; l = l.parent {
+		bytes += l.bytes
+		documents += l.documents
+	}
+	return bytes, documents
+}
+
+// writer returns a writer for the output of the template filename, which
+// writes to w until a limit is exceeded.
+func (l *outputLimits) writer(w io.Writer, filename string) io.Writer {
+	if l.maxBytes <= 0 && l.maxDocuments <= 0 {
+		return w
+	}
+	return &limitedWriter{limits: l, w: w, filename: filename}
+}
+
+type outputLimitError string
+
+func (e outputLimitError) Error() string { return string(e) }
+
+// limitedWriter counts the bytes written to w and the documents they start.
+// A document starts with the first character other than whitespace after the
+// start of the template or after a "---" separator line.
+type limitedWriter struct {
+	limits   *outputLimits
+	w        io.Writer
+	filename string
+
+	col       int  // the column of the next byte
+	dashes    int  // the number of dashes at the start of the current line
+	separator bool // the current line is a document separator
+	inDoc     bool // a document has started since the last separator
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	l := w.limits
+	bytes, documents := l.used()
+	if l.maxBytes > 0 && bytes+int64(len(p)) > l.maxBytes {
+		return 0, outputLimitError(fmt.Sprintf("rendering %s: output exceeds the limit of %d bytes", w.filename, l.maxBytes))
+	}
+	l.bytes += int64(len(p))
+	if l.maxDocuments > 0 {
+		for _, c := range p {
+			if w.scan(c) {
+				l.documents++
+				documents++
+				if documents > l.maxDocuments {
+					return 0, outputLimitError(fmt.Sprintf("rendering %s: output exceeds the limit of %d documents", w.filename, l.maxDocuments))
+				}
+			}
+		}
+	}
+	return w.w.Write(p)
+}
+
+// scan advances over c and reports whether it starts a document.
+func (w *limitedWriter) scan(c byte) bool {
+	if c == '\n' {
+		w.col, w.dashes, w.separator = 0, 0, false
+		return false
+	}
+	defer func() { w.col++ }()
+	if w.separator {
+		return false
+	}
+	if c == '-' && w.dashes == w.col && w.col < 3 {
+		w.dashes++
+		if w.dashes == 3 {
+			w.separator, w.inDoc = true, false
+		}
+		return false
+	}
+	if w.inDoc || (w.dashes == 0 && (c == ' ' || c == '\t' || c == '\r')) {
+		return false
+	}
+	w.inDoc = true
+	return true
+}
+
+// validate runs the Engine's validators over every document in the rendered
+// templates.
+func (e Engine) validate(rendered map[string]string) error {
+	if len(e.Validators) == 0 {
+		return nil
+	}
+
+	filenames := make([]string, 0, len(rendered))
+	for filename := range rendered {
+		// NOTES.txt is not a manifest.
+		if strings.HasSuffix(filename, notesFileSuffix) {
+			continue
+		}
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		docs := releaseutil.SplitManifests(rendered[filename])
+		keys := make([]string, 0, len(docs))
+		for k := range docs {
+			keys = append(keys, k)
+		}
+		sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+		for _, k := range keys {
+			doc := docs[k]
+			var head releaseutil.SimpleHead
+			// Documents that do not parse are still handed to the validators,
+			// with an empty kind.
+			_ = yaml.Unmarshal([]byte(doc), &head)
+			for _, validate := range e.Validators {
+				if err := validate(head.Kind, doc); err != nil {
+					return errors.Wrapf(err, "validation failed for %s in %s", head.Kind, filename)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalize re-encodes the YAML documents in the rendered templates with
+// their keys sorted. Documents that are not a YAML map or list, such as those
+// holding only comments or failing to parse, are kept as they are.
+func canonicalize(rendered map[string]string) {
+	for filename, content := range rendered {
+		if strings.HasSuffix(filename, notesFileSuffix) {
+			continue
+		}
+		docs := releaseutil.SplitManifests(content)
+		if len(docs) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(docs))
+		for k := range docs {
+			keys = append(keys, k)
+		}
+		sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+		var b strings.Builder
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString("---\n")
+			}
+			b.WriteString(canonicalDocument(docs[k]))
+		}
+		rendered[filename] = b.String()
+	}
+}
+
+func canonicalDocument(doc string) string {
+	var node yamlv3.Node
+	if err := yamlv3.Unmarshal([]byte(doc), &node); err == nil && len(node.Content) == 1 {
+		switch root := node.Content[0]; root.Kind {
+		case yamlv3.MappingNode, yamlv3.SequenceNode:
+			// Decoding checks the document, such as for aliases that expand
+			// to far more than the document itself, before canonicalNode
+			// expands them. The nodes are encoded, rather than the decoded
+			// values, so that scalars are kept as they were written, such as
+			// integers too large for an int64.
+			var v interface{}
+			if root.Decode(&v) != nil {
+				break
+			}
+			var b strings.Builder
+			enc := yamlv3.NewEncoder(&b)
+			enc.SetIndent(2)
+			if enc.Encode(canonicalNode(root)) == nil && enc.Close() == nil {
+				return b.String()
+			}
+		}
+	}
+	return doc + "\n"
+}
+
+// canonicalNode returns a copy of node with the keys of its mappings sorted,
+// aliases replaced by the nodes they refer to, and without comments or flow
+// and quoting styles.
+func canonicalNode(node *yamlv3.Node) *yamlv3.Node {
+	if node.Kind == yamlv3.AliasNode {
+		return canonicalNode(node.Alias)
+	}
+	out := &yamlv3.Node{
+		Kind:  node.Kind,
+		Style: node.Style & yamlv3.TaggedStyle,
+		Tag:   node.Tag,
+		Value: node.Value,
+	}
+	for _, n := range node.Content {
+		out.Content = append(out.Content, canonicalNode(n))
+	}
+	if node.Kind == yamlv3.MappingNode {
+		pairs := make([][2]*yamlv3.Node, 0, len(out.Content)/2)
+		for i := 0; i+1 < len(out.Content); i += 2 {
+			pairs = append(pairs, [2]*yamlv3.Node{out.Content[i], out.Content[i+1]})
+		}
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i][0].Value < pairs[j][0].Value })
+		out.Content = out.Content[:0]
+		for _, p := range pairs {
+			out.Content = append(out.Content, p[0], p[1])
+		}
+	}
+	return out
+}
+
 func cleanupParseError(filename string, err error) error {
 	tokens := strings.Split(err.Error(), ": ")
 	if len(tokens) == 1 {
@@ -372,21 +862,55 @@ func recAllTpls(c *chart.Chart, templates map[string]renderable, vals chartutil.
 		subCharts[child.Name()] = recAllTpls(child, templates, next)
 	}
 
+	var parentVals chartutil.Values
+	if !c.IsRoot() {
+		parentVals, _ = asMap(vals["Values"])
+	}
+
 	newParentID := c.ChartFullPath()
 	for _, t := range c.Templates {
 		if !isTemplateValid(c, t.Name) {
 			continue
 		}
 		templates[path.Join(newParentID, t.Name)] = renderable{
-			tpl:      string(t.Data),
-			vals:     next,
-			basePath: path.Join(newParentID, "templates"),
+			tpl:        string(t.Data),
+			vals:       next,
+			basePath:   path.Join(newParentID, "templates"),
+			parentVals: parentVals,
 		}
 	}
 
 	return next
 }
 
+// valueAt returns the value at the dotted path in vals, or nil if there is
+// none.
+func valueAt(vals chartutil.Values, path string) interface{} {
+	var v interface{} = vals
+	for _, k := range strings.Split(path, ".") {
+		m, ok := asMap(v)
+		if !ok {
+			return nil
+		}
+		if v, ok = m[k]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+// asMap returns v as a map if it is one.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case chartutil.Values:
+		return m, true
+	default:
+		return nil, false
+	}
+}
+
 // isTemplateValid returns true if the template is valid for the chart type
 func isTemplateValid(ch *chart.Chart, templateName string) bool {
 	if isLibraryChart(ch) {
@@ -17,10 +17,21 @@ limitations under the License.
 package engine
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
+	"net"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
 
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
@@ -70,7 +81,7 @@ func TestFuncMap(t *testing.T) {
 	}
 
 	// Test for Engine-specific template functions.
-	expect := []string{"include", "required", "tpl", "toYaml", "fromYaml", "toToml", "toJson", "fromJson", "lookup"}
+	expect := []string{"include", "required", "tpl", "toYaml", "fromYaml", "toToml", "toJson", "fromJson", "lookup", "lookupList"}
 	for _, f := range expect {
 		if _, ok := fns[f]; !ok {
 			t.Errorf("Expected add-on function %q", f)
@@ -126,6 +137,730 @@ func TestRender(t *testing.T) {
 	}
 }
 
+func TestRenderLayers(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/test1", Data: []byte("{{.Values.outer | title }} {{.Values.inner | title}}")},
+			{Name: "templates/test2", Data: []byte("{{.Values.global.callme | lower }}")},
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{define "helper"}}ignored{{end}}`)},
+		},
+		Values: map[string]interface{}{"outer": "DEFAULT", "inner": "DEFAULT"},
+	}
+
+	vals := map[string]interface{}{
+		"Values": map[string]interface{}{
+			"outer": "spouter",
+			"inner": "inn",
+			"global": map[string]interface{}{
+				"callme": "Ishmael",
+			},
+		},
+	}
+
+	v, err := chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+	layers, err := new(Engine).RenderLayers(c, v)
+	if err != nil {
+		t.Fatalf("Failed to render layers: %s", err)
+	}
+
+	expect := map[string]string{
+		"moby/templates/test1": "Spouter Inn",
+		"moby/templates/test2": "ishmael",
+	}
+	if len(layers) != len(expect) {
+		t.Fatalf("Expected %d layers, got %d", len(expect), len(layers))
+	}
+
+	for name, data := range expect {
+		layer, ok := layers[name]
+		if !ok {
+			t.Fatalf("Expected layer %q", name)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(layer))
+		if err != nil {
+			t.Fatalf("Layer %q is not gzipped: %s", name, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Failed to decompress layer %q: %s", name, err)
+		}
+		if string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+}
+
+func TestRenderValidators(t *testing.T) {
+	privileged := `apiVersion: v1
+kind: Pod
+metadata:
+  name: bad
+spec:
+  containers:
+  - name: app
+    image: app
+    securityContext:
+      privileged: {{ .Values.privileged }}
+`
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/config.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n")},
+			{Name: "templates/pod.yaml", Data: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: svc\n---\n" + privileged)},
+			{Name: "templates/NOTES.txt", Data: []byte("privileged: true")},
+		},
+	}
+
+	var kinds []string
+	noPrivileged := func(kind, doc string) error {
+		kinds = append(kinds, kind)
+		var obj struct {
+			Spec struct {
+				Containers []struct {
+					SecurityContext struct {
+						Privileged bool `json:"privileged"`
+					} `json:"securityContext"`
+				} `json:"containers"`
+			} `json:"spec"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return err
+		}
+		for _, c := range obj.Spec.Containers {
+			if c.SecurityContext.Privileged {
+				return errors.New("privileged containers are not allowed")
+			}
+		}
+		return nil
+	}
+	e := Engine{Validators: []func(string, string) error{noPrivileged}}
+
+	vals := chartutil.Values{"Values": map[string]interface{}{"privileged": false}}
+	v, err := chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+	if _, err := e.Render(c, v); err != nil {
+		t.Fatalf("Expected a clean render, got %s", err)
+	}
+	if expect := []string{"ConfigMap", "Service", "Pod"}; !reflect.DeepEqual(kinds, expect) {
+		t.Errorf("Expected validators to see %v, got %v", expect, kinds)
+	}
+
+	vals = chartutil.Values{"Values": map[string]interface{}{"privileged": true}}
+	v, err = chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+	_, err = e.Render(c, v)
+	if err == nil {
+		t.Fatal("Expected the privileged pod to be rejected")
+	}
+	expected := "validation failed for Pod in moby/templates/pod.yaml: privileged containers are not allowed"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestRenderGetHostByName(t *testing.T) {
+	// Count every attempt to reach a DNS server instead of making one.
+	var lookups int32
+	resolver := net.DefaultResolver
+	defer func() { net.DefaultResolver = resolver }()
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			atomic.AddInt32(&lookups, 1)
+			return nil, errors.New("network access is not allowed")
+		},
+	}
+
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/host", Data: []byte(`host: "{{ getHostByName "helm.invalid" }}"`)},
+		},
+	}
+	v, err := chartutil.CoalesceValues(c, chartutil.Values{})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	if _, ok := funcMap()["getHostByName"].(func(string) string); !ok {
+		t.Fatal("Expected getHostByName to be a placeholder in the default function map")
+	}
+	out, err := Engine{}.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/host"]; got != `host: ""` {
+		t.Errorf("Expected an empty host, got %q", got)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Errorf("Expected no DNS lookups by default, got %d", n)
+	}
+
+	// With DNS enabled the real lookup is made. It fails here, which sprig
+	// does not handle gracefully, so only the attempt is checked.
+	Engine{EnableDNS: true}.Render(c, v)
+	if n := atomic.LoadInt32(&lookups); n == 0 {
+		t.Error("Expected a DNS lookup with EnableDNS")
+	}
+}
+
+func TestRenderOutputLimits(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmaps", Data: []byte("{{ range until .Values.count }}---\nkind: ConfigMap\nmetadata:\n  name: cm-{{ . }}\n{{ end }}")},
+			{Name: "templates/service", Data: []byte("# leading comment\nkind: Service\n")},
+		},
+	}
+	render := func(e Engine, count int) (map[string]string, error) {
+		v, err := chartutil.CoalesceValues(c, chartutil.Values{"Values": map[string]interface{}{"count": count}})
+		if err != nil {
+			t.Fatalf("Failed to coalesce values: %s", err)
+		}
+		return e.Render(c, v)
+	}
+
+	// Within the limits, or without any, the output is complete.
+	for _, e := range []Engine{{}, {MaxOutputBytes: 400, MaxDocuments: 4}} {
+		out, err := render(e, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(out["moby/templates/configmaps"], "kind: ConfigMap"); n != 3 {
+			t.Errorf("Expected 3 config maps, got %d", n)
+		}
+	}
+
+	// A huge range fails as soon as a limit is exceeded, rather than after
+	// producing all of its output.
+	for _, tt := range []struct {
+		engine Engine
+		expect string
+	}{
+		{Engine{MaxDocuments: 3}, "rendering moby/templates/configmaps: output exceeds the limit of 3 documents"},
+		{Engine{MaxOutputBytes: 1 << 10}, "rendering moby/templates/configmaps: output exceeds the limit of 1024 bytes"},
+		{Engine{MaxDocuments: 100, CollectErrors: true}, "rendering moby/templates/configmaps: output exceeds the limit of 100 documents"},
+	} {
+		_, err := render(tt.engine, 1000000)
+		if err == nil {
+			t.Fatalf("Expected an error for %+v", tt.engine)
+		}
+		if err.Error() != tt.expect {
+			t.Errorf("Expected %q, got %q", tt.expect, err)
+		}
+	}
+
+	// The limits apply to the output of all templates together.
+	if _, err := render(Engine{MaxDocuments: 2}, 2); err == nil || !strings.Contains(err.Error(), "limit of 2 documents") {
+		t.Errorf("Expected the service to exceed the document limit, got %v", err)
+	}
+
+	// The output of include and tpl counts as it is built up, even when it
+	// is never written to the output of a template.
+	for _, tpl := range []string{
+		`{{ $big := include "moby/templates/_big" . }}small`,
+		`{{ $big := tpl "{{ range until 1000000 }}---\nkind: ConfigMap\n{{ end }}" . }}small`,
+	} {
+		nested := &chart.Chart{
+			Metadata: &chart.Metadata{Name: "moby", Version: "1.2.3"},
+			Templates: []*chart.File{
+				{Name: "templates/_big", Data: []byte("{{ range until 1000000 }}---\nkind: ConfigMap\n{{ end }}")},
+				{Name: "templates/small", Data: []byte(tpl)},
+			},
+		}
+		v, err := chartutil.CoalesceValues(nested, chartutil.Values{})
+		if err != nil {
+			t.Fatalf("Failed to coalesce values: %s", err)
+		}
+		for _, e := range []Engine{{MaxDocuments: 100}, {MaxOutputBytes: 1 << 10}, {MaxDocuments: 100, CollectErrors: true}} {
+			_, err := e.Render(nested, v)
+			var limitErr outputLimitError
+			if !errors.As(err, &limitErr) {
+				t.Errorf("Expected an output limit error for %+v from %s, got %v", e, tpl, err)
+			}
+		}
+	}
+}
+
+func TestRenderDelims(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "moby.name" }}[[{{ .Chart.Name }}]]{{ end }}`)},
+			{Name: "templates/rules", Data: []byte("alert: [[ .Values.alert ]]\nsummary: \"{{ $labels.instance }} is down\"\nname: [[ include \"moby.name\" . ]]")},
+			{Name: "templates/service", Data: []byte(`name: {{ include "moby.name" . }} [[ not an action ]]`)},
+		},
+		Values: map[string]interface{}{"alert": "InstanceDown"},
+	}
+	v, err := chartutil.ToRenderValues(c, chartutil.Values{}, chartutil.ReleaseOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	// Only the rules use other delimiters.
+	e := Engine{TemplateDelims: map[string][2]string{"moby/templates/rules": {"[[", "]]"}}}
+	out, err := e.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "alert: InstanceDown\nsummary: \"{{ $labels.instance }} is down\"\nname: [[moby]]"
+	if got := out["moby/templates/rules"]; got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+	if got := out["moby/templates/service"]; got != "name: [[moby]] [[ not an action ]]" {
+		t.Errorf("Expected the service to use the default delimiters, got %q", got)
+	}
+
+	// Snippets passed to tpl from the rules use the default delimiters, like
+	// the values they come from.
+	c.Templates = append(c.Templates, &chart.File{Name: "templates/tpl", Data: []byte(`[[ tpl .Values.message . ]] {{ $labels.job }}`)})
+	c.Values["message"] = "{{ .Values.alert }} fired"
+	if v, err = chartutil.ToRenderValues(c, chartutil.Values{}, chartutil.ReleaseOptions{}, nil); err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+	e.TemplateDelims["moby/templates/tpl"] = [2]string{"[[", "]]"}
+	if out, err = e.Render(c, v); err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/tpl"]; got != "InstanceDown fired {{ $labels.job }}" {
+		t.Errorf("Expected %q, got %q", "InstanceDown fired {{ $labels.job }}", got)
+	}
+
+	// Without the option, the rules are not valid templates.
+	if _, err := new(Engine).Render(c, v); err == nil {
+		t.Error("Expected the rules to fail to parse with the default delimiters")
+	}
+
+	// Delims applies to all templates.
+	c.Templates = []*chart.File{
+		{Name: "templates/rules", Data: []byte(`alert: [[ .Values.alert ]] {{ $labels.instance }}`)},
+	}
+	out, err = Engine{Delims: [2]string{"[[", "]]"}}.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/rules"]; got != "alert: InstanceDown {{ $labels.instance }}" {
+		t.Errorf("Expected %q, got %q", "alert: InstanceDown {{ $labels.instance }}", got)
+	}
+}
+
+func TestRenderOne(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "moby.name" }}{{ .Chart.Name }}-{{ .Values.suffix }}{{ end }}`)},
+			{Name: "templates/service", Data: []byte(`name: {{ include "moby.name" . }}`)},
+			{Name: "templates/failing", Data: []byte(`{{ fail "not rendered" }}`)},
+			{Name: "templates/broken", Data: []byte(`{{ define "moby.broken" }}ok{{ end }}{{ if }}`)},
+			{Name: "templates/uses-broken", Data: []byte(`{{ include "moby.broken" . }}`)},
+		},
+		Values: map[string]interface{}{"suffix": "svc"},
+	}
+	v, err := chartutil.ToRenderValues(c, chartutil.Values{}, chartutil.ReleaseOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	// The whole chart cannot be rendered.
+	if _, err := new(Engine).Render(c, v); err == nil {
+		t.Fatal("Expected the chart to fail to render")
+	}
+
+	for _, name := range []string{"moby/templates/service", "templates/service"} {
+		out, err := new(Engine).RenderOne(c, v, name)
+		if err != nil {
+			t.Fatalf("Failed to render %s: %s", name, err)
+		}
+		if out != "name: moby-svc" {
+			t.Errorf("Expected %q for %s, got %q", "name: moby-svc", name, out)
+		}
+	}
+
+	for name, expect := range map[string]string{
+		"templates/missing":      "not found",
+		"templates/_helpers.tpl": "partial",
+		"templates/failing":      "not rendered",
+		"templates/broken":       "parse error",
+		"templates/uses-broken":  `no template "moby.broken"`,
+	} {
+		_, err := new(Engine).RenderOne(c, v, name)
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("Expected an error containing %q for %s, got %v", expect, name, err)
+		}
+	}
+}
+
+func TestRenderFlags(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/flags", Data: []byte(`{{ flag "canary" }} {{ flag "legacy" }} {{ flag "unknown" }}`)},
+			{Name: "templates/gated", Data: []byte(`{{ if flag "canary" }}kind: Canary{{ end }}`)},
+		},
+	}
+	v, err := chartutil.CoalesceValues(c, chartutil.Values{})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	e := Engine{Flags: map[string]bool{"canary": true, "legacy": false}}
+	out, err := e.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/flags"]; got != "true false false" {
+		t.Errorf("Expected %q, got %q", "true false false", got)
+	}
+	if got := out["moby/templates/gated"]; got != "kind: Canary" {
+		t.Errorf("Expected the gated template to be rendered, got %q", got)
+	}
+
+	// Without flags, every flag is off.
+	out, err = new(Engine).Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/flags"]; got != "false false false" {
+		t.Errorf("Expected %q, got %q", "false false false", got)
+	}
+	if got := out["moby/templates/gated"]; got != "" {
+		t.Errorf("Expected the gated template to be empty, got %q", got)
+	}
+}
+
+func TestRenderStrict(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/missing", Data: []byte(`image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"`)},
+		},
+	}
+	vals := map[string]interface{}{
+		"Values": map[string]interface{}{
+			"image": map[string]interface{}{"repository": "nginx"},
+		},
+	}
+	v, err := chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	// By default a missing key renders as an empty string.
+	out, err := new(Engine).Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["moby/templates/missing"]; got != `image: "nginx:"` {
+		t.Errorf("Expected the missing tag to be empty, got %q", got)
+	}
+
+	e := Engine{Strict: true}
+	_, err = e.Render(c, v)
+	if err == nil {
+		t.Fatal("Expected an error in strict mode")
+	}
+	expect := `template: moby/templates/missing:1:49: executing "moby/templates/missing" at <.Values.image.tag>: map has no entry for key "tag"`
+	if err.Error() != expect {
+		t.Errorf("Expected %q, got %q", expect, err)
+	}
+}
+
+func TestRenderWithContext(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+	}
+	for i := 0; i < 100; i++ {
+		c.Templates = append(c.Templates, &chart.File{
+			Name: fmt.Sprintf("templates/t%03d", i),
+			Data: []byte(`{{ visit }}`),
+		})
+	}
+	v, err := chartutil.CoalesceValues(c, chartutil.Values{})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visits := 0
+	e := Engine{CustomTemplateFuncs: template.FuncMap{"visit": func() string {
+		visits++
+		if visits == 3 {
+			cancel()
+		}
+		return "visited"
+	}}}
+
+	out, err := e.RenderWithContext(ctx, c, v)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if len(out) != 0 {
+		t.Errorf("Expected no output, got %d templates", len(out))
+	}
+	if visits != 3 {
+		t.Errorf("Expected the render to stop after 3 templates, got %d", visits)
+	}
+
+	// Render does not stop early.
+	visits = 0
+	e.CustomTemplateFuncs["visit"] = func() string {
+		visits++
+		return "visited"
+	}
+	out, err = e.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 100 || visits != 100 {
+		t.Errorf("Expected 100 templates to be rendered, got %d (%d visits)", len(out), visits)
+	}
+}
+
+func TestRenderCustomTemplateFuncs(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "greeting" }}hello{{ end }}`)},
+			{Name: "templates/secret", Data: []byte(`{{ vaultLookup "secret/db" }} {{ upper "x" }} {{ include "greeting" . }}`)},
+		},
+	}
+	v, err := chartutil.CoalesceValues(c, chartutil.Values{})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	e := Engine{CustomTemplateFuncs: template.FuncMap{
+		"vaultLookup": func(path string) string { return "s3cr3t-" + path },
+		"upper":       func(s string) string { return "upper(" + s + ")" },
+		"include":     func(string, interface{}) string { return "overridden" },
+	}}
+	out, err := e.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "s3cr3t-secret/db upper(x) hello"
+	if got := out["moby/templates/secret"]; got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+}
+
+func TestRenderParentValue(t *testing.T) {
+	child := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "child", Version: "0.1.0"},
+		Templates: []*chart.File{
+			{Name: "templates/config", Data: []byte(`host={{ parentValue "database.host" }} port={{ parentValue "database.port" }} missing={{ parentValue "database.user.name" | default "none" }}`)},
+			{Name: "templates/tpl", Data: []byte(`{{ tpl "host={{ parentValue \"database.host\" }}" . }}`)},
+		},
+	}
+	parent := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "parent", Version: "0.1.0"},
+		Values: map[string]interface{}{
+			"database": map[string]interface{}{"host": "pg.example.com", "port": 5432},
+		},
+		Templates: []*chart.File{
+			{Name: "templates/config", Data: []byte(`{{ parentValue "database.host" | default "standalone" }}`)},
+			{Name: "templates/tpl", Data: []byte(`{{ tpl "host={{ parentValue \"database.host\" | default \"standalone\" }}" . }}`)},
+		},
+	}
+	parent.AddDependency(child)
+
+	v, err := chartutil.CoalesceValues(parent, map[string]interface{}{
+		"database": map[string]interface{}{"host": "db.internal"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+	out, err := Render(parent, chartutil.Values{"Values": v})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"parent/templates/config":              "standalone",
+		"parent/charts/child/templates/config": "host=db.internal port=5432 missing=none",
+		"parent/templates/tpl":                 "host=standalone",
+		"parent/charts/child/templates/tpl":    "host=db.internal",
+	}
+	for name, data := range expect {
+		if out[name] != data {
+			t.Errorf("Expected %q for %s, got %q", data, name, out[name])
+		}
+	}
+}
+
+func TestRenderCollectErrors(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/good", Data: []byte(`fine`)},
+			{Name: "templates/parse", Data: []byte("line one\n{{ if }}")},
+			{Name: "templates/exec", Data: []byte("line one\nline two\n{{ fail \"broken\" }}")},
+		},
+	}
+	v, err := chartutil.CoalesceValues(c, chartutil.Values{})
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	// By default, the render stops at the first error.
+	_, err = new(Engine).Render(c, v)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if _, ok := err.(RenderErrors); ok {
+		t.Errorf("Expected a single error by default, got %s", err)
+	}
+
+	e := Engine{CollectErrors: true}
+	out, err := e.Render(c, v)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(out) != 0 {
+		t.Errorf("Expected no output, got %v", out)
+	}
+	errs, ok := err.(RenderErrors)
+	if !ok {
+		t.Fatalf("Expected RenderErrors, got %T: %s", err, err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %s", len(errs), err)
+	}
+	expect := []string{
+		"parse error at (moby/templates/parse:2): missing value for if",
+		"execution error at (moby/templates/exec:3:3): broken",
+	}
+	for i, msg := range expect {
+		if errs[i].Error() != msg {
+			t.Errorf("Expected error %d to be %q, got %q", i, msg, errs[i])
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "2 templates failed to render:\n") {
+		t.Errorf("Unexpected error message %q", err)
+	}
+}
+
+func TestRenderCanonicalOutput(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:    "moby",
+			Version: "1.2.3",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte(`# the data is generated
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- range $k, $v := .Values.labels }}
+    {{ $k }}: {{ $v | quote }}
+    {{- end }}
+kind: ConfigMap
+apiVersion: v1
+data:
+{{ toYaml .Values.data | indent 2 }}
+---
+# only a comment
+---
+- zeta
+- {b: 2, a: 1, big: 123456789012345678901234567890}`)},
+			{Name: "templates/NOTES.txt", Data: []byte("kind: not a manifest\napiVersion: v1")},
+		},
+	}
+	vals := map[string]interface{}{
+		"Values": map[string]interface{}{
+			"labels": map[string]interface{}{"tier": "web", "app": "moby"},
+			"data":   map[string]interface{}{"z": "last", "a": "first"},
+		},
+		"Release": map[string]interface{}{"Name": "whale"},
+	}
+	v, err := chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		t.Fatalf("Failed to coalesce values: %s", err)
+	}
+
+	e := Engine{CanonicalOutput: true}
+	out, err := e.Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `apiVersion: v1
+data:
+  a: first
+  z: last
+kind: ConfigMap
+metadata:
+  labels:
+    app: moby
+    tier: web
+  name: whale
+---
+# only a comment
+---
+- zeta
+- a: 1
+  b: 2
+  big: 123456789012345678901234567890
+`
+	if got := out["moby/templates/configmap.yaml"]; got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+	if got := out["moby/templates/NOTES.txt"]; got != "kind: not a manifest\napiVersion: v1" {
+		t.Errorf("Expected NOTES.txt to be left alone, got %q", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		again, err := e.Render(c, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again["moby/templates/configmap.yaml"] != expect {
+			t.Fatalf("Expected identical output, got %q", again["moby/templates/configmap.yaml"])
+		}
+	}
+}
+
 func TestRenderRefsOrdering(t *testing.T) {
 	parentChart := &chart.Chart{
 		Metadata: &chart.Metadata{
@@ -830,3 +1565,57 @@ func TestRenderRecursionLimit(t *testing.T) {
 	}
 
 }
+
+func TestRenderTplRepeated(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "TplFunction"},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "greet" }}hello {{ . }}{{ end }}`)},
+			{Name: "templates/base", Data: []byte(`{{ range .Values.names }}{{ tpl $.Values.snippet (dict "name" . "Template" $.Template) }};{{ end }}{{ tpl "{{ len .Values.names }}" . }}`)},
+		},
+	}
+	v := chartutil.Values{
+		"Values": chartutil.Values{
+			"names":   []interface{}{"a", "b", "c"},
+			"snippet": `{{ include "greet" .name }}`,
+		},
+		"Chart": c.Metadata,
+	}
+
+	out, err := Render(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "hello a;hello b;hello c;3"
+	if got := out["TplFunction/templates/base"]; got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+}
+
+func BenchmarkRenderTplRepeated(b *testing.B) {
+	helpers := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		helpers = append(helpers, fmt.Sprintf(`{{ define "helper%d" }}{{ .Values.name | upper | quote }}{{ end }}`, i))
+	}
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "TplFunction"},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(strings.Join(helpers, "\n"))},
+			{Name: "templates/annotations", Data: []byte(`{{ range until 1000 }}{{ tpl $.Values.annotation $ }}{{ end }}`)},
+		},
+	}
+	v := chartutil.Values{
+		"Values": chartutil.Values{
+			"name":       "moby",
+			"annotation": `example.com/owner: {{ include "helper42" . }}`,
+		},
+		"Chart": c.Metadata,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Render(c, v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
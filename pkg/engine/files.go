@@ -22,6 +22,8 @@ import (
 	"strings"
 
 	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
 
 	"helm.sh/helm/v3/pkg/chart"
 )
@@ -63,6 +65,28 @@ func (f files) Get(name string) string {
 	return string(f.GetBytes(name))
 }
 
+// GetYaml parses the named file as a YAML map.
+//
+// Unlike {{ .Files.Get "foo.yaml" | fromYaml }}, it fails when the file does
+// not exist or is not valid YAML, so that a misspelled name stops the render.
+// A file that exists but is empty, or holds only comments, is an empty map.
+//
+//	{{ $config := .Files.GetYaml "config/defaults.yaml" }}
+func (f files) GetYaml(name string) (map[string]interface{}, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, errors.Errorf("file %q not found in chart", name)
+	}
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s", name)
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	return m, nil
+}
+
 // Glob takes a glob pattern and returns another files object only containing
 // matched  files.
 //
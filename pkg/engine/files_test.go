@@ -96,3 +96,30 @@ func TestLines(t *testing.T) {
 
 	as.Equal("bar", out[0])
 }
+
+func TestGetYaml(t *testing.T) {
+	as := assert.New(t)
+
+	f := getTestFiles()
+	f["config/app.yaml"] = []byte("name: moby\nports: [80, 443]\n")
+	f["config/empty.yaml"] = []byte{}
+	f["config/comments.yaml"] = []byte("# nothing here yet\n")
+	f["config/null.yaml"] = []byte("~\n")
+	f["config/broken.yaml"] = []byte("name: [moby\n")
+
+	out, err := f.GetYaml("config/app.yaml")
+	as.NoError(err)
+	as.Equal(map[string]interface{}{"name": "moby", "ports": []interface{}{float64(80), float64(443)}}, out)
+
+	for _, name := range []string{"config/empty.yaml", "config/comments.yaml", "config/null.yaml"} {
+		out, err := f.GetYaml(name)
+		as.NoError(err, name)
+		as.Equal(map[string]interface{}{}, out, name)
+	}
+
+	_, err = f.GetYaml("config/missing.yaml")
+	as.EqualError(err, `file "config/missing.yaml" not found in chart`)
+
+	_, err = f.GetYaml("config/broken.yaml")
+	as.Error(err)
+}
@@ -18,13 +18,50 @@ package engine
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
+	"github.com/Masterminds/semver/v3"
 	"github.com/Masterminds/sprig/v3"
+	"github.com/distribution/distribution/v3/reference"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/blowfish"
+	yamlv3 "gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/yaml"
+
+	"helm.sh/helm/v3/pkg/chartutil"
 )
 
 // funcMap returns a mapping of all of the functions that Engine has.
@@ -37,6 +74,11 @@ import (
 //
 //	- "include"
 //	- "tpl"
+//	- "lookup"
+//	- "lookupList"
+//	- "lookupWithSelector"
+//	- "parentValue"
+//	- "flag"
 //
 // These are late-bound in Engine.Render().  The
 // version included in the FuncMap is a placeholder.
@@ -48,13 +90,107 @@ func funcMap() template.FuncMap {
 
 	// Add some extra functionality
 	extra := template.FuncMap{
-		"toToml":        toTOML,
-		"toYaml":        toYAML,
-		"fromYaml":      fromYAML,
-		"fromYamlArray": fromYAMLArray,
-		"toJson":        toJSON,
-		"fromJson":      fromJSON,
-		"fromJsonArray": fromJSONArray,
+		"toToml":            toTOML,
+		"toYaml":            toYAML,
+		"toYamlArray":       toYAMLArray,
+		"toYamlTyped":       toYAMLTyped,
+		"fromYaml":          fromYAML,
+		"fromYamlStrict":    fromYAMLStrict,
+		"fromYamlOrdered":   fromYAMLOrdered,
+		"toYamlOrdered":     toYAMLOrdered,
+		"fromYamlArray":     fromYAMLArray,
+		"mergeYamlDocs":     mergeYAMLDocs,
+		"toJson":            toJSON,
+		"fromJson":          fromJSON,
+		"fromJsonArray":     fromJSONArray,
+		"fromJsonNumbers":   fromJSONNumbers,
+		"mustFromJsonArray": mustFromJSONArray,
+		"toCsv":             toCSV,
+		"fromCsv":           fromCSV,
+
+		"chartSemverMatch": chartSemverMatch,
+		"semverMajor":      semverMajor,
+		"semverMinor":      semverMinor,
+		"semverPatch":      semverPatch,
+		"semverPrerelease": semverPrerelease,
+		"isValidResource": func(obj map[string]interface{}) bool {
+			ok, _ := isValidResource(obj)
+			return ok
+		},
+		"validateResource": validateResource,
+		"isValidYaml": func(str string) bool {
+			ok, _ := isValidYAML(str)
+			return ok
+		},
+		"validateYaml":          validateYAML,
+		"jsonSchemaValidate":    jsonSchemaValidate,
+		"readinessGate":         readinessGate,
+		"toEnvList":             toEnvList,
+		"toDotenv":              toDotenv,
+		"toConfigMapData":       toConfigMapData,
+		"b64encBytes":           b64encBytes,
+		"b32encLower":           b32encLower,
+		"b32decLower":           b32decLower,
+		"b64decBytes":           b64decBytes,
+		"wrapChunks":            wrapChunks,
+		"indentRest":            indentRest,
+		"wordWrap":              wordWrap,
+		"fingerprint":           fingerprint,
+		"htpasswdReuse":         htpasswdReuse,
+		"htpasswdSeeded":        htpasswdSeeded,
+		"deterministicPassword": deterministicPassword,
+		"sha256sumAll":          sha256sumAll,
+		"normalizeImage":        normalizeImage,
+		"archImage":             archImage,
+		"priorityClassRef":      priorityClassRef,
+		"priorityClass":         priorityClass,
+		"lifecycleHook":         lifecycleHook,
+		"hostPath":              hostPath,
+		"toDNS1123":             toDNS1123,
+		"toKebab":               toKebab,
+		"toSnake":               toSnake,
+		"requireDistinctNodes":  requireDistinctNodes,
+		"requireNodeCapacity":   requireNodeCapacity,
+		"requireTogether":       requireTogether,
+		"cpuToNanos":            cpuToNanos,
+		"nanosToCpu":            nanosToCPU,
+		"memoryToBytes":         memoryToBytes,
+		"bytesToMemory":         bytesToMemory,
+		"quantityMul":           quantityMul,
+		"quantityAdd":           quantityAdd,
+		"resourceOrDefault":     resourceOrDefault,
+		"cloneValues":           cloneValues,
+		"applyJsonPatch":        applyJSONPatch,
+		"strategicMergePatch":   strategicMergePatch,
+		"flattenMap":            flattenMap,
+		"unflattenMap":          unflattenMap,
+		"diffMaps":              diffMaps,
+		"mergeMapsStrict":       mergeMapsStrict,
+		"coalesceEmpty":         coalesceEmpty,
+		"toBool":                toBool,
+		"sortBy":                sortBy,
+		"uniqBy":                uniqBy,
+		"setUnion":              setUnion,
+		"setIntersect":          setIntersect,
+		"setDifference":         setDifference,
+		"filterIn":              filterIn,
+		"filterOp":              filterOp,
+		"parseSelector":         parseSelector,
+		"kustomization":         kustomization,
+		"webhookClientConfig":   webhookClientConfig,
+		"rolloutControl":        rolloutControl,
+		"durationSeconds":       durationSeconds,
+		"toRFC3339":             toRFC3339,
+		"parseRFC3339":          parseRFC3339,
+		"timestampLabel":        timestampLabel,
+		"replaceLiteral":        replaceLiteral,
+		"reindent":              reindent,
+		"urlPathEscape":         url.PathEscape,
+		"urlPathUnescape":       urlPathUnescape,
+		"urlQueryEscape":        url.QueryEscape,
+		"urlQueryUnescape":      urlQueryUnescape,
+		"cidrHost":              cidrHost,
+		"cidrContains":          cidrContains,
 
 		// This is a placeholder for the "include" function, which is
 		// late-bound to a template. By declaring it here, we preserve the
@@ -67,6 +203,22 @@ func funcMap() template.FuncMap {
 		"lookup": func(string, string, string, string) (map[string]interface{}, error) {
 			return map[string]interface{}{}, nil
 		},
+		"lookupList": func(string, string, string, string) ([]interface{}, error) {
+			return []interface{}{}, nil
+		},
+		// The selector is still validated so that malformed selectors are
+		// caught without a cluster connection.
+		"lookupWithSelector": func(_, _, _, selector string) (map[string]interface{}, error) {
+			return map[string]interface{}{}, validateFieldSelector(selector)
+		},
+		// The "parentValue" function is bound to the template being rendered.
+		"parentValue": func(string) interface{} { return nil },
+		// The "flag" function reads the flags set on the Engine, so every
+		// flag is off outside of one.
+		"flag": func(string) bool { return false },
+		// Sprig's "getHostByName" performs a DNS lookup, which makes rendering
+		// non-deterministic. It is only enabled by Engine.EnableDNS.
+		"getHostByName": func(string) string { return "" },
 	}
 
 	for k, v := range extra {
@@ -79,6 +231,12 @@ func funcMap() template.FuncMap {
 // toYAML takes an interface, marshals it to yaml, and returns a string. It will
 // always return a string, even on marshal error (empty string).
 //
+// Map keys are emitted in lexicographic order at every level of nesting, so the
+// output is stable across renders.
+//
+// Keys with a nil value, including nil maps and slices, are kept and emitted
+// as an explicit null, so that a strategic merge patch deletes the field.
+//
 // This is designed to be called from a template.
 func toYAML(v interface{}) string {
 	data, err := yaml.Marshal(v)
@@ -89,6 +247,34 @@ func toYAML(v interface{}) string {
 	return strings.TrimSuffix(string(data), "\n")
 }
 
+// toYAMLArray is like toYAML, but always emits a YAML sequence. A value that is
+// not a slice or an array is wrapped in a sequence of one item, and nil is
+// emitted as an empty sequence.
+//
+// This is designed to be called from a template.
+func toYAMLArray(v interface{}) string {
+	if v == nil {
+		return "[]"
+	}
+	if kind := reflect.TypeOf(v).Kind(); kind != reflect.Slice && kind != reflect.Array {
+		v = []interface{}{v}
+	} else if reflect.ValueOf(v).Len() == 0 {
+		return "[]"
+	}
+	return toYAML(v)
+}
+
+// toYAMLTyped is like toYAML, but encodes v directly as YAML rather than
+// through JSON, so that the fields of a struct, such as one returned by a
+// custom template function, are named by their yaml tags instead of their json
+// tags. Fields without a yaml tag are named in lower case.
+//
+// This is designed to be called from a template. It returns an empty string if
+// v cannot be encoded.
+func toYAMLTyped(v interface{}) string {
+	return encodeYAMLv3(v)
+}
+
 // fromYAML converts a YAML document into a map[string]interface{}.
 //
 // This is not a general-purpose YAML parser, and will not parse all valid
@@ -104,6 +290,582 @@ func fromYAML(str string) map[string]interface{} {
 	return m
 }
 
+// orderedMap is a YAML mapping that keeps its keys in the order they were
+// parsed, as returned by fromYAMLOrdered.
+type orderedMap []orderedMapItem
+
+type orderedMapItem struct {
+	Key   string
+	Value interface{}
+}
+
+// Get returns the value of key, or nil if m does not have it.
+func (m orderedMap) Get(key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// MarshalYAML emits m as a mapping with its keys in order.
+func (m orderedMap) MarshalYAML() (interface{}, error) {
+	node := &yamlv3.Node{Kind: yamlv3.MappingNode}
+	for _, item := range m {
+		var value yamlv3.Node
+		if err := value.Encode(item.Value); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content,
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: item.Key},
+			&value,
+		)
+	}
+	if len(m) == 0 {
+		node.Style = yamlv3.FlowStyle
+	}
+	return node, nil
+}
+
+// fromYAMLOrdered is like fromYAML, but keeps the keys of mappings in the order
+// they appear in str, so that toYAMLOrdered emits them in the same order:
+//
+//	{{- .Values.extraConfig | fromYamlOrdered | toYamlOrdered | nindent 4 }}
+//
+// Mappings are returned as a list of items with a Key and a Value, and
+// their values can be looked up with Get. This is designed to be called from a
+// template. Like fromYAML, it tolerates errors: the returned map only holds the
+// error message under the key "Error".
+func fromYAMLOrdered(str string) orderedMap {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal([]byte(str), &doc); err != nil {
+		return orderedMap{{Key: "Error", Value: err.Error()}}
+	}
+	v, err := orderedValue(&doc)
+	if err != nil {
+		return orderedMap{{Key: "Error", Value: err.Error()}}
+	}
+	switch v := v.(type) {
+	case nil:
+		return orderedMap{}
+	case orderedMap:
+		return v
+	default:
+		return orderedMap{{Key: "Error", Value: fmt.Sprintf("expected a map, got %T", v)}}
+	}
+}
+
+// orderedValue converts a parsed YAML node to its value, with mappings as
+// orderedMaps and sequences as []interface{}.
+func orderedValue(node *yamlv3.Node) (interface{}, error) {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return orderedValue(node.Content[0])
+	case yamlv3.AliasNode:
+		return orderedValue(node.Alias)
+	case yamlv3.MappingNode:
+		m := make(orderedMap, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v, err := orderedValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, orderedMapItem{Key: node.Content[i].Value, Value: v})
+		}
+		return m, nil
+	case yamlv3.SequenceNode:
+		list := make([]interface{}, 0, len(node.Content))
+		for _, item := range node.Content {
+			v, err := orderedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	default:
+		var v interface{}
+		err := node.Decode(&v)
+		return v, err
+	}
+}
+
+// toYAMLOrdered is like toYAML, but emits the maps returned by fromYAMLOrdered
+// with their keys in their original order. Other maps are emitted with sorted
+// keys.
+//
+// This is designed to be called from a template. It returns an empty string if
+// v cannot be encoded.
+func toYAMLOrdered(v interface{}) string {
+	return encodeYAMLv3(v)
+}
+
+// encodeYAMLv3 encodes v with yaml.v3 and an indentation of two spaces, or
+// returns an empty string if v cannot be encoded.
+func encodeYAMLv3(v interface{}) (out string) {
+	// yaml.v3 panics on values it cannot encode, such as functions.
+	defer func() {
+		if recover() != nil {
+			out = ""
+		}
+	}()
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return ""
+	}
+	if err := enc.Close(); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// mergeYAMLDocs parses each of docs, which may hold several YAML documents,
+// and deep-merges the documents into a single map in order, so that later
+// documents win. Maps are merged key by key, while any other value replaces
+// the earlier one. Empty and null documents are skipped.
+//
+// This is designed to be called from a template. Like fromYAML, it tolerates
+// errors: if a document is not valid YAML or is not a map, the returned map
+// only holds the error message in m["Error"].
+func mergeYAMLDocs(docs ...string) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, doc := range docs {
+		dec := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(doc), 4096)
+		for {
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return map[string]interface{}{"Error": err.Error()}
+			}
+			if v == nil {
+				continue
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return map[string]interface{}{"Error": fmt.Sprintf("cannot merge a document of type %T", v)}
+			}
+			deepMerge(merged, m)
+		}
+	}
+	return merged
+}
+
+// deepMerge merges src into dst, replacing the values of dst with those of src
+// unless both are maps, which are merged in turn.
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				deepMerge(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// mergeMapsStrict deep-merges maps like mergeYAMLDocs, but fails if two of them
+// set the same key to different values, rather than letting the last one win,
+// such as for annotations contributed by several sources:
+//
+//	annotations: {{- mergeMapsStrict .Values.annotations .Values.ingress.annotations | toYaml | nindent 4 }}
+//
+// Setting a key to an equal value again is allowed. The maps are not modified.
+func mergeMapsStrict(maps ...map[string]interface{}) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	for _, m := range maps {
+		if err := strictMerge(merged, m, ""); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// strictMerge merges src into dst like deepMerge, but returns an error if they
+// have a key with different values, unless both are maps. Keys are merged in
+// sorted order, so the error names the same key every time.
+func strictMerge(dst, src map[string]interface{}, prefix string) error {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := src[k]
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = cloneValues(v)
+			continue
+		}
+		dm, dok := existing.(map[string]interface{})
+		sm, sok := v.(map[string]interface{})
+		if dok && sok {
+			if err := strictMerge(dm, sm, prefix+k+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if !looseEqual(existing, v) {
+			return fmt.Errorf("conflicting values for %q: %v and %v", prefix+k, existing, v)
+		}
+	}
+	return nil
+}
+
+// applyJSONPatch applies patch, a JSON Patch (RFC 6902) given as a JSON string
+// or as a list of operations, to a copy of doc and returns the result:
+//
+//	{{- $patch := list (dict "op" "replace" "path" "/spec/replicas" "value" 3) }}
+//	{{- applyJsonPatch $patch .Values.base | toYaml }}
+//
+// This is designed to be called from a template. Like fromJSON, it tolerates
+// errors: if the patch is invalid or cannot be applied, the returned map only
+// holds the error message in m["Error"].
+func applyJSONPatch(patch interface{}, doc map[string]interface{}) map[string]interface{} {
+	fail := func(err error) map[string]interface{} {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	patchJSON, ok := patch.(string)
+	if !ok {
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return fail(err)
+		}
+		patchJSON = string(data)
+	}
+	p, err := jsonpatch.DecodePatch([]byte(patchJSON))
+	if err != nil {
+		return fail(err)
+	}
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		return fail(err)
+	}
+	patched, err := p.Apply(docJSON)
+	if err != nil {
+		return fail(err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(patched, &m); err != nil {
+		return fail(err)
+	}
+	return m
+}
+
+// strategicMergePatch applies patch to a copy of base as a strategic merge
+// patch for the built-in Kubernetes kind gvk, given as the apiVersion and kind
+// separated by a slash, such as "apps/v1/Deployment" or "v1/Pod". Lists with a
+// merge key, such as the containers of a pod, are merged item by item, as by
+// kubectl patch:
+//
+//	{{- strategicMergePatch .Values.base .Values.overrides "apps/v1/Deployment" | toYaml }}
+//
+// This is designed to be called from a template. Like fromJSON, it tolerates
+// errors: if gvk is not a built-in kind or the patch cannot be applied, the
+// returned map only holds the error message in m["Error"].
+func strategicMergePatch(base, patch map[string]interface{}, gvk string) map[string]interface{} {
+	i := strings.LastIndex(gvk, "/")
+	if i < 0 {
+		return map[string]interface{}{"Error": fmt.Sprintf("invalid kind %q: expected the apiVersion and kind separated by a slash", gvk)}
+	}
+	obj, err := scheme.Scheme.New(schema.FromAPIVersionAndKind(gvk[:i], gvk[i+1:]))
+	if err != nil {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	patched, err := strategicpatch.StrategicMergeMapPatch(cloneMap(base), cloneMap(patch), obj)
+	if err != nil {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	return patched
+}
+
+// diffMaps compares the maps a and b, such as the desired and the current
+// configuration, and returns the keys that b added, removed and changed:
+//
+//	drift: {{- diffMaps .Values.desired $current | toYaml | nindent 2 }}
+//
+// The result has the keys "added" and "removed", with the values of the keys
+// only in b and only in a, and "changed", with the old and new value of the
+// keys whose values differ, such as {"replicas": {"old": 1, "new": 3}}. Maps
+// in both a and b are compared recursively, and their differences are nested
+// under the same key in each of the three. Numbers are equal if they have the
+// same value, whatever their type.
+func diffMaps(a, b map[string]interface{}) map[string]interface{} {
+	added, removed, changed := map[string]interface{}{}, map[string]interface{}{}, map[string]interface{}{}
+	for k, old := range a {
+		v, ok := b[k]
+		if !ok {
+			removed[k] = old
+			continue
+		}
+		oldMap, aok := old.(map[string]interface{})
+		newMap, bok := v.(map[string]interface{})
+		if aok && bok {
+			diff := diffMaps(oldMap, newMap)
+			for _, section := range []struct {
+				name string
+				m    map[string]interface{}
+			}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+				if d := diff[section.name].(map[string]interface{}); len(d) > 0 {
+					section.m[k] = d
+				}
+			}
+			continue
+		}
+		if !deepLooseEqual(old, v) {
+			changed[k] = map[string]interface{}{"old": old, "new": v}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			added[k] = v
+		}
+	}
+	return map[string]interface{}{"added": added, "removed": removed, "changed": changed}
+}
+
+// deepLooseEqual is like looseEqual, but also compares the items of lists and
+// maps with looseEqual.
+func deepLooseEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !deepLooseEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			bv, ok := b[k]
+			if !ok || !deepLooseEqual(v, bv) {
+				return false
+			}
+		}
+		return true
+	default:
+		return looseEqual(a, b)
+	}
+}
+
+// flattenMap flattens the nested maps and lists of m into a single map, whose
+// keys are the paths to the values in m joined by sep, with the indices of list
+// items as segments:
+//
+//	{{- range $k, $v := flattenMap "." .Values.config }}
+//	{{ $k }}={{ $v }}
+//	{{- end }}
+//
+// For example {"a": {"b": [1, 2]}} is flattened to {"a.b.0": 1, "a.b.1": 2}.
+// Empty maps and lists are kept as values, so that they are not lost.
+func flattenMap(sep string, m map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	flattenInto(flat, sep, "", m)
+	return flat
+}
+
+func flattenInto(flat map[string]interface{}, sep, prefix string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && prefix != "" {
+			flat[prefix] = v
+		}
+		for k, item := range v {
+			key := k
+			if prefix != "" {
+				key = prefix + sep + k
+			}
+			flattenInto(flat, sep, key, item)
+		}
+	case chartutil.Values:
+		flattenInto(flat, sep, prefix, map[string]interface{}(v))
+	case []interface{}:
+		if len(v) == 0 {
+			flat[prefix] = v
+		}
+		for i, item := range v {
+			flattenInto(flat, sep, prefix+sep+strconv.Itoa(i), item)
+		}
+	default:
+		flat[prefix] = v
+	}
+}
+
+// unflattenMap is the inverse of flattenMap: it splits the keys of m by sep and
+// nests the values under the resulting paths:
+//
+//	config: {{- unflattenMap "." .Values.flatConfig | toYaml | nindent 2 }}
+//
+// For example {"a.b.0": 1, "a.b.1": 2} becomes {"a": {"b": [1, 2]}}. A map
+// whose keys are the indices 0 to n-1 becomes a list, while any other map is
+// kept, such that {"a.0": 1, "a.2": 2} becomes {"a": {"0": 1, "2": 2}}.
+//
+// This is designed to be called from a template. Like fromYAML, it tolerates
+// errors: if a key is both a value and the parent of another, such as "a" and
+// "a.b", the returned map only holds the error message in m["Error"].
+func unflattenMap(sep string, m map[string]interface{}) map[string]interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	root := unflattened{}
+	for _, k := range keys {
+		segments := strings.Split(k, sep)
+		if sep == "" {
+			segments = []string{k}
+		}
+		parent := root
+		for i, segment := range segments[:len(segments)-1] {
+			existing, ok := parent[segment]
+			if !ok {
+				child := unflattened{}
+				parent[segment] = child
+				parent = child
+				continue
+			}
+			child, ok := existing.(unflattened)
+			if !ok {
+				return map[string]interface{}{"Error": fmt.Sprintf("key %q is both a value and a parent of %q", strings.Join(segments[:i+1], sep), k)}
+			}
+			parent = child
+		}
+		last := segments[len(segments)-1]
+		if _, ok := parent[last].(unflattened); ok {
+			return map[string]interface{}{"Error": fmt.Sprintf("key %q is both a value and a parent of another key", k)}
+		}
+		parent[last] = m[k]
+	}
+	return root.nest().(map[string]interface{})
+}
+
+// unflattened is a map built by unflattenMap, as opposed to a value of the
+// flat map.
+type unflattened map[string]interface{}
+
+// nest converts u and the maps it holds to maps or, if their keys are the
+// indices of a list, to lists.
+func (u unflattened) nest() interface{} {
+	m := make(map[string]interface{}, len(u))
+	for k, v := range u {
+		if child, ok := v.(unflattened); ok {
+			v = child.nest()
+		}
+		m[k] = v
+	}
+	if len(m) == 0 {
+		return m
+	}
+	list := make([]interface{}, len(m))
+	for k, v := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(list) || strconv.Itoa(i) != k {
+			return m
+		}
+		list[i] = v
+	}
+	return list
+}
+
+// fromYAMLStrict converts a YAML document into a map[string]interface{} like
+// fromYAML, but rejects documents with duplicate keys instead of letting the
+// last one win.
+//
+// Any error is inserted into m["Error"] in the returned map.
+func fromYAMLStrict(str string) map[string]interface{} {
+	m := map[string]interface{}{}
+
+	if err := yaml.UnmarshalStrict([]byte(str), &m); err != nil {
+		m["Error"] = err.Error()
+	}
+	return m
+}
+
+// isValidYAML reports whether str is a well-formed YAML document. If it is not,
+// the returned string describes the first problem and the line it is on, such
+// as a tab used for indentation, a key nested at the wrong level or a
+// duplicate key.
+//
+// Unlike fromYAML, it is meant for catching mistakes in user-supplied
+// snippets, which fromYAML would parse into a partial map.
+func isValidYAML(str string) (bool, string) {
+	var v interface{}
+	if err := yaml.UnmarshalStrict([]byte(str), &v); err != nil {
+		// The prefix describes how the YAML is decoded, not what is wrong
+		// with it.
+		return false, strings.TrimPrefix(err.Error(), "error converting YAML to JSON: ")
+	}
+	return true, ""
+}
+
+// validateYAML returns str unchanged if it passes isValidYAML, and an error
+// describing the problem otherwise.
+//
+// This is designed to be called from a template, where the error fails the
+// render.
+func validateYAML(str string) (string, error) {
+	if ok, msg := isValidYAML(str); !ok {
+		return str, fmt.Errorf("invalid YAML: %s", msg)
+	}
+	return str, nil
+}
+
+// jsonSchemaValidate returns document unchanged if it is valid against the
+// JSON Schema schema, and an error listing every violation otherwise. Both the
+// schema and the document can be given as a map or as a JSON string:
+//
+//	{{- $schema := .Files.Get "files/config.schema.json" }}
+//	config.yaml: |
+//	  {{- .Values.appConfig | jsonSchemaValidate $schema | toYaml | nindent 2 }}
+//
+// This is designed to be called from a template, where the error fails the
+// render.
+func jsonSchemaValidate(schema, document interface{}) (interface{}, error) {
+	result, err := gojsonschema.Validate(jsonSchemaLoader(schema), jsonSchemaLoader(document))
+	if err != nil {
+		return document, fmt.Errorf("jsonSchemaValidate: %s", err)
+	}
+	if !result.Valid() {
+		var sb strings.Builder
+		sb.WriteString("document does not match the schema:")
+		for _, desc := range result.Errors() {
+			sb.WriteString("\n- ")
+			sb.WriteString(desc.String())
+		}
+		return document, errors.New(sb.String())
+	}
+	return document, nil
+}
+
+func jsonSchemaLoader(v interface{}) gojsonschema.JSONLoader {
+	switch v := v.(type) {
+	case string:
+		return gojsonschema.NewStringLoader(v)
+	case chartutil.Values:
+		return gojsonschema.NewGoLoader(map[string]interface{}(v))
+	default:
+		return gojsonschema.NewGoLoader(v)
+	}
+}
+
 // fromYAMLArray converts a YAML array into a []interface{}.
 //
 // This is not a general-purpose YAML parser, and will not parse all valid
@@ -136,6 +898,9 @@ func toTOML(v interface{}) string {
 // toJSON takes an interface, marshals it to json, and returns a string. It will
 // always return a string, even on marshal error (empty string).
 //
+// Map keys are emitted in lexicographic order at every level of nesting, so the
+// output is stable across renders.
+//
 // This is designed to be called from a template.
 func toJSON(v interface{}) string {
 	data, err := json.Marshal(v)
@@ -161,6 +926,29 @@ func fromJSON(str string) map[string]interface{} {
 	return m
 }
 
+// fromJSONNumbers is like fromJSON, but keeps numbers as json.Number instead
+// of converting them to float64, so that large integers and decimals are
+// emitted exactly as they were written by toJson, and integers by toYaml too:
+//
+//	accountId: {{ (fromJsonNumbers .Values.account).id }}
+//
+// Like fromJSON, it tolerates errors by inserting the error message into
+// m["Error"].
+func fromJSONNumbers(str string) map[string]interface{} {
+	m := make(map[string]interface{})
+
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.UseNumber()
+	err := dec.Decode(&m)
+	if err == nil && dec.More() {
+		err = errors.New("invalid data after the JSON document")
+	}
+	if err != nil {
+		m["Error"] = err.Error()
+	}
+	return m
+}
+
 // fromJSONArray converts a JSON array into a []interface{}.
 //
 // This is not a general-purpose JSON parser, and will not parse all valid
@@ -175,3 +963,2007 @@ func fromJSONArray(str string) []interface{} {
 	}
 	return a
 }
+
+// mustFromJSONArray converts a JSON array into a []interface{}.
+//
+// Unlike fromJSONArray it returns the parse error, so that a template using it
+// fails to render instead of working with the error message as an item, like
+// sprig's mustFromJson does for any JSON document.
+func mustFromJSONArray(str string) ([]interface{}, error) {
+	a := []interface{}{}
+
+	if err := json.Unmarshal([]byte(str), &a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// toCSV takes a list of rows, either a [][]string or a []interface{} whose
+// items are lists of fields, and encodes them as CSV. Fields that are not
+// strings are formatted with fmt.Sprint. Fields containing commas, quotes or
+// newlines are quoted as needed. It will always return a string, even on
+// error (empty string).
+//
+// This is designed to be called from a template.
+func toCSV(rows interface{}) string {
+	var records [][]string
+	switch rs := rows.(type) {
+	case [][]string:
+		records = rs
+	case []interface{}:
+		records = make([][]string, 0, len(rs))
+		for _, r := range rs {
+			switch fields := r.(type) {
+			case []string:
+				records = append(records, fields)
+			case []interface{}:
+				record := make([]string, len(fields))
+				for i, f := range fields {
+					record[i] = fmt.Sprint(f)
+				}
+				records = append(records, record)
+			default:
+				// Swallow errors inside of a template.
+				return ""
+			}
+		}
+	default:
+		return ""
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	if err := w.WriteAll(records); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// fromCSV converts a CSV document into a [][]string. Every row must have the
+// same number of fields.
+//
+// Because its intended use is within templates it tolerates errors. It will
+// insert the returned error message string as the only field of the first and
+// only row in the returned array.
+func fromCSV(str string) [][]string {
+	records, err := csv.NewReader(strings.NewReader(str)).ReadAll()
+	if err != nil {
+		return [][]string{{err.Error()}}
+	}
+	return records
+}
+
+// chartSemverMatch reports whether version satisfies constraint using the same
+// rules Helm applies when it looks up a chart version in a repository index,
+// which differ from those of semverCompare:
+//
+//   - An empty constraint matches any release version, rather than being an
+//     error.
+//   - A version that is string-equal to the constraint always matches.
+//   - A version that is not valid semver never matches, rather than being an
+//     error.
+//
+// Otherwise, both use the same constraints, so pre-release versions only
+// match constraints that themselves carry a pre-release (e.g. ">=1.0.0-0").
+func chartSemverMatch(constraint, version string) (bool, error) {
+	expr := constraint
+	if expr == "" {
+		expr = "*"
+	}
+	c, err := semver.NewConstraint(expr)
+	if err != nil {
+		return false, err
+	}
+	if constraint != "" && constraint == version {
+		return true, nil
+	}
+
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false, nil
+	}
+	return c.Check(v), nil
+}
+
+// semverMajor returns the major version of version, such as 1 for "v1.2.3",
+// to build an API group or toggle a feature:
+//
+//	{{- if ge (semverMajor .Chart.AppVersion) 2 }}
+//
+// Because its intended use is within templates it tolerates errors. If
+// version is not a semantic version, the error message string is returned
+// instead. The same applies to semverMinor, semverPatch and semverPrerelease.
+func semverMajor(version string) interface{} {
+	return semverPart(version, func(v *semver.Version) interface{} { return int(v.Major()) })
+}
+
+// semverMinor returns the minor version of version, such as 2 for "v1.2.3".
+func semverMinor(version string) interface{} {
+	return semverPart(version, func(v *semver.Version) interface{} { return int(v.Minor()) })
+}
+
+// semverPatch returns the patch version of version, such as 3 for "v1.2.3".
+func semverPatch(version string) interface{} {
+	return semverPart(version, func(v *semver.Version) interface{} { return int(v.Patch()) })
+}
+
+// semverPrerelease returns the pre-release of version, such as "rc.1" for
+// "1.2.3-rc.1+build.5", or an empty string for a release.
+func semverPrerelease(version string) interface{} {
+	return semverPart(version, func(v *semver.Version) interface{} { return v.Prerelease() })
+}
+
+func semverPart(version string, part func(*semver.Version) interface{}) interface{} {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return fmt.Sprintf("invalid version %q: %s", version, err)
+	}
+	return part(v)
+}
+
+// isValidResource reports whether obj carries the fields every Kubernetes
+// object needs: apiVersion, kind and metadata.name. If it does not, the
+// returned string names the first missing field.
+//
+// This is only a structural check. It does not consult any schema.
+func isValidResource(obj map[string]interface{}) (bool, string) {
+	for _, key := range []string{"apiVersion", "kind"} {
+		if s, ok := obj[key].(string); !ok || s == "" {
+			return false, fmt.Sprintf("missing %s", key)
+		}
+	}
+	var metadata map[string]interface{}
+	switch m := obj["metadata"].(type) {
+	case map[string]interface{}:
+		metadata = m
+	case chartutil.Values:
+		metadata = m
+	default:
+		return false, "missing metadata"
+	}
+	if s, ok := metadata["name"].(string); !ok || s == "" {
+		return false, "missing metadata.name"
+	}
+	return true, ""
+}
+
+// validateResource returns obj unchanged if it passes isValidResource, and an
+// error describing the missing field otherwise.
+//
+// This is designed to be called from a template, where the error fails the
+// render.
+func validateResource(obj map[string]interface{}) (map[string]interface{}, error) {
+	if ok, reason := isValidResource(obj); !ok {
+		return obj, fmt.Errorf("invalid resource: %s", reason)
+	}
+	return obj, nil
+}
+
+// readinessGate returns a pod readinessGates entry for the custom condition
+// conditionType. The condition type must be a qualified name, such as
+// "example.com/feature-1".
+func readinessGate(conditionType string) (map[string]interface{}, error) {
+	if errs := validation.IsQualifiedName(conditionType); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid readiness gate condition type %q: %s", conditionType, strings.Join(errs, "; "))
+	}
+	return map[string]interface{}{"conditionType": conditionType}, nil
+}
+
+// sha256sumAll returns a single SHA-256 checksum over the contents of several
+// files, such as for a checksum annotation that changes whenever any of them
+// does:
+//
+//	checksum/config: {{ sha256sumAll (.Files.Get "a.yaml") (.Files.Get "b.yaml") }}
+//
+// The result does not depend on the order of the arguments. Each content is
+// hashed separately and the sorted digests are hashed together, so contents are
+// never concatenated and cannot run into each other.
+func sha256sumAll(contents ...string) string {
+	sums := make([]string, len(contents))
+	for i, c := range contents {
+		sum := sha256.Sum256([]byte(c))
+		sums[i] = hex.EncodeToString(sum[:])
+	}
+	sort.Strings(sums)
+
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write([]byte(sum))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// passwordAlphabet is the alphabet of deterministicPassword, the same as that
+// of sprig's randAlphaNum.
+const passwordAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// maxPasswordLength is the longest password deterministicPassword generates.
+const maxPasswordLength = 1024
+
+// deterministicPassword derives an alphanumeric password of length characters
+// from seed with HMAC-SHA256, so that it stays the same across upgrades of a
+// release, unlike one from randAlphaNum:
+//
+//	password: {{ deterministicPassword (printf "%s/%s/admin" .Release.Name .Values.passwordSeed) 24 | b64enc }}
+//
+// The password is only as secret as seed: anyone who knows the seed can derive
+// it. Include a secret in the seed, not just the release name.
+func deterministicPassword(seed string, length int) (string, error) {
+	if length <= 0 || length > maxPasswordLength {
+		return "", fmt.Errorf("invalid password length %d: must be between 1 and %d", length, maxPasswordLength)
+	}
+	// Bytes from the end of the range that would make some characters more
+	// likely than others are skipped.
+	limit := byte(256 - 256%len(passwordAlphabet))
+	password := make([]byte, 0, length)
+	for counter := uint32(0); len(password) < length; counter++ {
+		mac := hmac.New(sha256.New, []byte(seed))
+		fmt.Fprintf(mac, "password-%d", counter)
+		for _, b := range mac.Sum(nil) {
+			if b < limit && len(password) < length {
+				password = append(password, passwordAlphabet[int(b)%len(passwordAlphabet)])
+			}
+		}
+	}
+	return string(password), nil
+}
+
+// htpasswdReuse returns previous, an htpasswd line such as the one in the
+// Secret of an earlier release, if it is for user and its bcrypt hash matches
+// password. Otherwise it returns a new line like sprig's htpasswd:
+//
+//	{{- $previous := "" }}
+//	{{- with lookup "v1" "Secret" .Release.Namespace "basic-auth" }}
+//	{{- $previous = index .data "auth" | b64dec }}
+//	{{- end }}
+//	auth: {{ htpasswdReuse "admin" .Values.password $previous | b64enc }}
+//
+// A bcrypt hash has a random salt, so htpasswd returns a different line on
+// every render. Each upgrade would then change the Secret, and restart the
+// pods that have a checksum of it, even though the password is the same.
+// Reusing the previous line keeps the Secret stable until the password
+// changes. Without a previous line, such as with helm template, use
+// htpasswdSeeded instead.
+func htpasswdReuse(user, password, previous string) (string, error) {
+	if err := checkHtpasswd(user, password); err != nil {
+		return "", err
+	}
+	if prevUser, hash, ok := strings.Cut(strings.TrimSpace(previous), ":"); ok && prevUser == user {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return user + ":" + hash, nil
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + string(hash), nil
+}
+
+// htpasswdSeeded is like sprig's htpasswd, but derives the salt of the bcrypt
+// hash from seed and user, so that every render with the same seed produces
+// the same line, even without access to the cluster:
+//
+//	auth: {{ htpasswdSeeded "admin" .Values.password .Release.Name | b64enc }}
+//
+// The salt is public in the hash, so seed does not need to be a secret, but
+// every release should use a different one.
+func htpasswdSeeded(user, password, seed string) (string, error) {
+	if err := checkHtpasswd(user, password); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(seed))
+	mac.Write([]byte(user))
+	hash, err := bcryptHash([]byte(password), bcrypt.DefaultCost, mac.Sum(nil)[:16])
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + hash, nil
+}
+
+func checkHtpasswd(user, password string) error {
+	if user == "" || strings.Contains(user, ":") {
+		return fmt.Errorf("invalid htpasswd user %q", user)
+	}
+	// Older versions of bcrypt silently ignore the rest of the password.
+	if len(password) > 72 {
+		return errors.New("bcrypt passwords cannot be longer than 72 bytes")
+	}
+	return nil
+}
+
+// bcryptEncoding is the base64 alphabet of bcrypt hashes.
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptHash returns the bcrypt hash of password, of at most 72 bytes, with
+// the given cost and 16-byte salt. golang.org/x/crypto/bcrypt always
+// generates a random salt, so this follows its implementation with the salt
+// as an argument.
+func bcryptHash(password []byte, cost int, salt []byte) (string, error) {
+	// Like the C implementations, include the terminating NUL in the key.
+	key := append(password[:len(password):len(password)], 0)
+	c, err := blowfish.NewSaltedCipher(key, salt)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < 1<<cost; i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(salt, c)
+	}
+
+	data := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(data); i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(data[i:i+8], data[i:i+8])
+		}
+	}
+	// Like the C implementations, only encode 23 of the 24 bytes.
+	return fmt.Sprintf("$2a$%02d$%s%s", cost, bcryptEncoding.EncodeToString(salt), bcryptEncoding.EncodeToString(data[:23])), nil
+}
+
+// imageArchitectures are the architectures archImage accepts, named as in
+// Go's GOARCH and in OCI image indexes.
+var imageArchitectures = map[string]bool{
+	"386":      true,
+	"amd64":    true,
+	"arm":      true,
+	"arm64":    true,
+	"mips64le": true,
+	"ppc64le":  true,
+	"riscv64":  true,
+	"s390x":    true,
+}
+
+// archImage returns the image reference ref with its tag suffixed by "-arch",
+// the convention for per-architecture tags, such as "nginx:1.25-arm64". A ref
+// without a tag is treated as "latest", and one already carrying the suffix is
+// returned unchanged.
+//
+// A ref pinned by digest identifies a single image already, so it is returned
+// unchanged. An unknown architecture, or a tag suffixed with a different one,
+// is an error.
+func archImage(ref, arch string) (string, error) {
+	if strings.Contains(ref, "@") {
+		return ref, nil
+	}
+	if !imageArchitectures[arch] {
+		return "", fmt.Errorf("unknown architecture %q", arch)
+	}
+
+	// A colon before the last slash separates a registry port, not a tag.
+	name, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if strings.HasSuffix(tag, "-"+arch) {
+		return name + ":" + tag, nil
+	}
+	for a := range imageArchitectures {
+		if strings.HasSuffix(tag, "-"+a) {
+			return "", fmt.Errorf("image %q is already tagged for architecture %s, not %s", ref, a, arch)
+		}
+	}
+	return name + ":" + tag + "-" + arch, nil
+}
+
+// normalizeImage validates the image reference ref and returns it in its
+// canonical form, with the registry and, for Docker Hub, the library namespace
+// made explicit, and the tag "latest" if it has neither a tag nor a digest:
+//
+//	image: {{ printf "%s/%s:%s" .Values.image.registry .Values.image.repository .Values.image.tag | normalizeImage }}
+//
+// For example "nginx" becomes "docker.io/library/nginx:latest". A reference
+// with both a tag and a digest is an error, since it is not clear which one is
+// meant.
+func normalizeImage(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %s", ref, err)
+	}
+	_, tagged := named.(reference.Tagged)
+	_, digested := named.(reference.Digested)
+	if tagged && digested {
+		return "", fmt.Errorf("invalid image reference %q: it has both a tag and a digest", ref)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// priorityClassRef returns the priorityClassName field of a pod spec referring
+// to the PriorityClass name. The name must be a DNS-1123 subdomain.
+func priorityClassRef(name string) (map[string]interface{}, error) {
+	if err := validatePriorityClassName(name); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"priorityClassName": name}, nil
+}
+
+// highestUserDefinablePriority is the largest value a PriorityClass created
+// outside of the system namespace may have. Larger values are reserved for
+// system critical pods.
+const highestUserDefinablePriority = 1000000000
+
+// priorityClass returns a scheduling.k8s.io/v1 PriorityClass named name with
+// the given value.
+func priorityClass(name string, value int) (map[string]interface{}, error) {
+	if err := validatePriorityClassName(name); err != nil {
+		return nil, err
+	}
+	if value > highestUserDefinablePriority || value < -highestUserDefinablePriority*2 {
+		return nil, fmt.Errorf("invalid priority class value %d: must be between %d and %d", value, -highestUserDefinablePriority*2, highestUserDefinablePriority)
+	}
+	return map[string]interface{}{
+		"apiVersion": "scheduling.k8s.io/v1",
+		"kind":       "PriorityClass",
+		"metadata":   map[string]interface{}{"name": name},
+		"value":      value,
+	}, nil
+}
+
+func validatePriorityClassName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid priority class name %q: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lifecycleHook returns a container lifecycle entry for the hook kind, which
+// must be "preStop" or "postStart". spec holds exactly one handler, keyed by
+// "exec", "httpGet" or "tcpSocket", for example:
+//
+//	lifecycleHook "preStop" (dict "exec" (dict "command" (list "sleep" "5")))
+//
+// An exec handler requires a command, and the network handlers require a port.
+func lifecycleHook(kind string, spec map[string]interface{}) (map[string]interface{}, error) {
+	if kind != "preStop" && kind != "postStart" {
+		return nil, fmt.Errorf("invalid lifecycle hook %q: must be preStop or postStart", kind)
+	}
+	if len(spec) != 1 {
+		return nil, fmt.Errorf("invalid %s hook: exactly one handler must be set", kind)
+	}
+
+	for handler, v := range spec {
+		h, ok := asMap(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s hook: %s handler must be a map", kind, handler)
+		}
+		switch handler {
+		case "exec":
+			if command, ok := h["command"].([]interface{}); !ok || len(command) == 0 {
+				return nil, fmt.Errorf("invalid %s hook: exec handler requires a command", kind)
+			}
+		case "httpGet", "tcpSocket":
+			if port, ok := h["port"]; !ok || port == "" || port == nil {
+				return nil, fmt.Errorf("invalid %s hook: %s handler requires a port", kind, handler)
+			}
+		default:
+			return nil, fmt.Errorf("invalid %s hook: unknown handler %q", kind, handler)
+		}
+	}
+	return map[string]interface{}{kind: spec}, nil
+}
+
+// hostPathTypes are the values Kubernetes accepts for the type of a hostPath
+// volume. The empty string skips all checks on the node.
+var hostPathTypes = []string{"", "DirectoryOrCreate", "Directory", "FileOrCreate", "File", "Socket", "CharDevice", "BlockDevice"}
+
+// hostPath returns a hostPath volume source for p, for example:
+//
+//	volumes:
+//	- name: docker
+//	  hostPath: {{ hostPath "/var/run/docker.sock" "Socket" | toJson }}
+//
+// p must be an absolute path on the node, and kind one of the hostPath types
+// such as "Directory" or "File". The type is omitted when kind is empty.
+func hostPath(p, kind string) (map[string]interface{}, error) {
+	if !path.IsAbs(p) {
+		return nil, fmt.Errorf("invalid host path %q: must be absolute", p)
+	}
+	valid := false
+	for _, t := range hostPathTypes {
+		if kind == t {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid type %q for host path %s: must be one of %s", kind, p, strings.Join(hostPathTypes[1:], ", "))
+	}
+
+	source := map[string]interface{}{"path": path.Clean(p)}
+	if kind != "" {
+		source["type"] = kind
+	}
+	return source, nil
+}
+
+// toDNS1123 turns s into a valid DNS-1123 label, as required for the names of
+// most Kubernetes objects. It lowercases s, replaces every character other than
+// a-z and 0-9 with a dash, collapses repeated dashes, trims dashes from both
+// ends and truncates the result to 63 characters. Leading digits are kept,
+// since DNS-1123 labels allow them.
+//
+// If nothing is left, such as when s has no valid characters at all, a name
+// derived from the hash of s is returned, so that the result is always a valid
+// label and distinct inputs stay distinct.
+func toDNS1123(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	name := strings.Trim(b.String(), "-")
+	if len(name) > validation.DNS1123LabelMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1123LabelMaxLength], "-")
+	}
+	if name == "" {
+		sum := sha256.Sum256([]byte(s))
+		name = "x-" + hex.EncodeToString(sum[:])[:8]
+	}
+	return name
+}
+
+// requireDistinctNodes returns a pod affinity that requires the pods labelled
+// labelKey=labelValue to be scheduled onto distinct nodes, so that minNodes
+// replicas cannot share a single point of failure. If minNodes is 1 there is
+// nothing to spread, and an empty affinity is returned.
+//
+// Since required anti-affinity leaves surplus replicas unschedulable, it is
+// best paired with requireNodeCapacity.
+func requireDistinctNodes(labelKey, labelValue string, minNodes interface{}) (map[string]interface{}, error) {
+	n, err := toWholeNumber(minNodes)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid node count %v: must be a positive integer", minNodes)
+	}
+	if errs := validation.IsQualifiedName(labelKey); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid label key %q: %s", labelKey, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(labelValue); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid label value %q: %s", labelValue, strings.Join(errs, "; "))
+	}
+	if n == 1 {
+		return map[string]interface{}{}, nil
+	}
+	return map[string]interface{}{
+		"podAntiAffinity": map[string]interface{}{
+			"requiredDuringSchedulingIgnoredDuringExecution": []interface{}{
+				map[string]interface{}{
+					"labelSelector": map[string]interface{}{
+						"matchLabels": map[string]interface{}{labelKey: labelValue},
+					},
+					"topologyKey": "kubernetes.io/hostname",
+				},
+			},
+		},
+	}, nil
+}
+
+// requireNodeCapacity fails the render if replicas pods, each requiring a
+// distinct node, cannot fit onto availableNodes nodes. It returns an empty
+// string otherwise, so it can be called inline:
+//
+//	{{- requireNodeCapacity .Values.replicas .Values.availableNodes }}
+func requireNodeCapacity(replicas, availableNodes interface{}) (string, error) {
+	r, err := toWholeNumber(replicas)
+	if err != nil {
+		return "", fmt.Errorf("invalid replica count %v: %s", replicas, err)
+	}
+	n, err := toWholeNumber(availableNodes)
+	if err != nil {
+		return "", fmt.Errorf("invalid node count %v: %s", availableNodes, err)
+	}
+	if r > n {
+		return "", fmt.Errorf("%d replicas require distinct nodes, but only %d nodes are available", r, n)
+	}
+	return "", nil
+}
+
+// toWholeNumber converts a number from a template to an int64. Numbers read
+// from values files are float64, so those are accepted if they are whole.
+func toWholeNumber(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, fmt.Errorf("%v is not a whole number", n)
+		}
+		return int64(n), nil
+	case json.Number:
+		return n.Int64()
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+}
+
+// cpuToNanos converts a Kubernetes CPU quantity, such as "500m" or "1.5", to
+// nanocpus, the unit Docker and containerd use for CPU limits.
+func cpuToNanos(s string) (int64, error) {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpu quantity %q: %s", s, err)
+	}
+	return q.ScaledValue(resource.Nano), nil
+}
+
+// nanosToCPU converts nanocpus, a whole number, to a Kubernetes CPU quantity
+// in canonical form, such as "500m".
+func nanosToCPU(nanos interface{}) (string, error) {
+	n, err := toWholeNumber(nanos)
+	if err != nil {
+		return "", fmt.Errorf("invalid nanocpus %v: %s", nanos, err)
+	}
+	return resource.NewScaledQuantity(n, resource.Nano).String(), nil
+}
+
+// memoryToBytes converts a Kubernetes memory quantity, such as "512Mi" or
+// "1G", to bytes. Fractional bytes are rounded up.
+func memoryToBytes(s string) (int64, error) {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory quantity %q: %s", s, err)
+	}
+	return q.Value(), nil
+}
+
+// bytesToMemory converts bytes to a Kubernetes memory quantity. Binary suffixes
+// such as "Mi" are preferred, falling back to decimal ones such as "k" when the
+// value is not a whole multiple of a binary unit.
+func bytesToMemory(bytes interface{}) (string, error) {
+	n, err := toWholeNumber(bytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid bytes %v: %s", bytes, err)
+	}
+	return resource.NewQuantity(n, resource.BinarySI).String(), nil
+}
+
+// quantityMul multiplies a Kubernetes resource quantity by factor, a number or
+// a numeric string, and returns the result as a canonical quantity:
+//
+//	-Xmx{{ quantityMul .Values.resources.limits.memory 0.75 | memoryToBytes }}
+//
+// The result keeps the binary or decimal suffixes of quantity where it can, so
+// that "512Mi" multiplied by 0.75 is "384Mi".
+func quantityMul(quantity string, factor interface{}) (string, error) {
+	q, err := resource.ParseQuantity(quantity)
+	if err != nil {
+		return "", fmt.Errorf("invalid quantity %q: %s", quantity, err)
+	}
+	fq, err := resource.ParseQuantity(quantityString(factor))
+	if err != nil {
+		return "", fmt.Errorf("invalid factor %v: %s", factor, err)
+	}
+	product := q.AsDec()
+	product.Mul(product, fq.AsDec())
+	return resource.NewDecimalQuantity(*product, q.Format).String(), nil
+}
+
+// quantityAdd adds two Kubernetes resource quantities, such as "1Gi" and
+// "512Mi", and returns the sum as a canonical quantity in the format of a.
+func quantityAdd(a, b string) (string, error) {
+	qa, err := resource.ParseQuantity(a)
+	if err != nil {
+		return "", fmt.Errorf("invalid quantity %q: %s", a, err)
+	}
+	qb, err := resource.ParseQuantity(b)
+	if err != nil {
+		return "", fmt.Errorf("invalid quantity %q: %s", b, err)
+	}
+	qa.Add(qb)
+	return qa.String(), nil
+}
+
+// resourceOrDefault returns value as a canonical resource quantity, or def if
+// value is missing or empty, for a request that has a default in the chart:
+//
+//	targetCPU: {{ resourceOrDefault .Values.resources.requests.cpu "100m" }}
+//
+// Both can be strings or numbers, such as a CPU count read from a values file.
+// An invalid quantity is an error, even if it is def and not used.
+func resourceOrDefault(value, def interface{}) (string, error) {
+	d, err := resource.ParseQuantity(quantityString(def))
+	if err != nil {
+		return "", fmt.Errorf("invalid default quantity %v: %s", def, err)
+	}
+	if value == nil || strings.TrimSpace(quantityString(value)) == "" {
+		return d.String(), nil
+	}
+	q, err := resource.ParseQuantity(quantityString(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid quantity %v: %s", value, err)
+	}
+	return q.String(), nil
+}
+
+// quantityString formats v for resource.ParseQuantity. Floats are written in
+// plain decimal notation, as fmt would print a large one as "1e+06".
+func quantityString(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toConfigMapData renders a map as the data of a ConfigMap, with the keys in
+// sorted order. Single-line values are double-quoted, and multi-line ones are
+// written as literal block scalars, which keeps them readable:
+//
+//	data:
+//	  {{- toConfigMapData .Values.files | nindent 2 }}
+//
+// A multi-line value that has trailing whitespace on one of its lines cannot be
+// a block scalar without losing it, so it is double-quoted instead. Values that
+// are not strings are formatted with fmt.Sprint. An empty map renders as "{}".
+//
+// This is designed to be called from a template. It returns an empty string if
+// the map cannot be encoded.
+func toConfigMapData(m map[string]interface{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	node := &yamlv3.Node{Kind: yamlv3.MappingNode}
+	for _, k := range keys {
+		var v string
+		if m[k] != nil {
+			v = fmt.Sprint(m[k])
+		}
+		style := yamlv3.DoubleQuotedStyle
+		if strings.Contains(v, "\n") {
+			style = yamlv3.LiteralStyle
+		}
+		node.Content = append(node.Content,
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: k},
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: v, Style: style},
+		)
+	}
+	if len(keys) == 0 {
+		node.Style = yamlv3.FlowStyle
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return ""
+	}
+	if err := enc.Close(); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// toEnvList renders a map as the list of name/value pairs expected by a
+// container's env field. Keys are emitted in sorted order, and every value is
+// quoted, since Kubernetes requires env values to be strings. An empty map
+// renders as "[]".
+//
+// This is designed to be called from a template.
+func toEnvList(m map[string]interface{}) string {
+	if len(m) == 0 {
+		return "[]"
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		// JSON strings are valid double-quoted YAML scalars.
+		name, _ := json.Marshal(k)
+		value, _ := json.Marshal(envValue(m[k]))
+		fmt.Fprintf(&b, "- name: %s\n  value: %s", name, value)
+	}
+	return b.String()
+}
+
+// envValue formats v the way a user would have written it in values.yaml.
+func envValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// Numbers parsed from YAML or JSON arrive as float64. Avoid
+		// exponent notation for large integers.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// dotenvKey matches the names of environment variables a .env file can set.
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dotenvBare matches the values that need no quotes in a .env file.
+var dotenvBare = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,-]*$`)
+
+// toDotenv renders a map as the lines of a .env file, KEY=value, in sorted
+// order. If upper is true, the keys are converted to upper case:
+//
+//	.env: |
+//	  {{- toDotenv .Values.env true | nindent 4 }}
+//
+// Values are formatted as by toEnvList. A value with characters other than
+// letters, digits and _./:@%+,- is double-quoted, with backslashes, double
+// quotes, dollar signs and line breaks escaped, so that it is read back as it
+// is. A key that is not a valid variable name, or two keys with the same name
+// in upper case, are an error. An empty map renders as an empty string.
+func toDotenv(m map[string]interface{}, upper ...bool) (string, error) {
+	keys := make(map[string]string, len(m))
+	names := make([]string, 0, len(m))
+	for k := range m {
+		name := k
+		if len(upper) > 0 && upper[0] {
+			name = strings.ToUpper(k)
+		}
+		if !dotenvKey.MatchString(name) {
+			return "", fmt.Errorf("toDotenv: %q is not a valid variable name", k)
+		}
+		if other, ok := keys[name]; ok {
+			return "", fmt.Errorf("toDotenv: %q and %q are both %s", other, k, name)
+		}
+		keys[name] = k
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		value := envValue(m[keys[name]])
+		if !dotenvBare.MatchString(value) {
+			value = `"` + dotenvEscaper.Replace(value) + `"`
+		}
+		lines = append(lines, name+"="+value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+
+// b64encBytes base64 encodes b, such as the result of .Files.GetBytes.
+//
+// Unlike b64enc it does not require the content to be converted to a string
+// first, and it encodes directly into an output buffer sized up front, so a
+// large file is only copied once.
+func b64encBytes(b []byte) string {
+	var out strings.Builder
+	out.Grow(base64.StdEncoding.EncodedLen(len(b)))
+	enc := base64.NewEncoder(base64.StdEncoding, &out)
+	// Writes to a strings.Builder never fail.
+	_, _ = enc.Write(b)
+	_ = enc.Close()
+	return out.String()
+}
+
+// wrapChunks splits s into lines of width characters, the last of which may be
+// shorter, such as to wrap base64 encoded data at 64 columns like PEM:
+//
+//	{{ .Files.Get "ca.der" | b64enc | wrapChunks 64 }}
+//
+// Characters are counted as runes, so a multi-byte character is never split. If
+// width is not positive, s is returned unchanged.
+func wrapChunks(width int, s string) string {
+	if width <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	var b strings.Builder
+	for i := 0; i < len(runes); i += width {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		end := i + width
+		if end > len(runes) {
+			end = len(runes)
+		}
+		b.WriteString(string(runes[i:end]))
+	}
+	return b.String()
+}
+
+// indentRest indents every line of text but the first by spaces, for a value
+// that starts on the line of its key, which already positions the first line:
+//
+//	args: [{{ .Values.args | join ",\n" | indentRest 8 }}]
+//
+// Empty lines, including the one after a trailing newline, are left empty so
+// that no trailing whitespace is emitted.
+func indentRest(spaces int, text string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = pad + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wordWrap wraps text so that no line is longer than width characters, for a
+// long description in an annotation:
+//
+//	description: |
+//	  {{- .Values.description | wordWrap 76 | nindent 4 }}
+//
+// Lines are broken between words, at spaces and tabs, and the whitespace at a
+// break is dropped. The line breaks of text are kept. A word longer than width
+// is not split and has a line to itself. A width of 0 or less returns text
+// unchanged.
+func wordWrap(width int, text string) string {
+	if width <= 0 {
+		return text
+	}
+
+	var b strings.Builder
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		n := 0
+		for _, word := range strings.Fields(line) {
+			l := len([]rune(word))
+			switch {
+			case n == 0:
+			case n+1+l > width:
+				b.WriteByte('\n')
+				n = 0
+			default:
+				b.WriteByte(' ')
+				n++
+			}
+			b.WriteString(word)
+			n += l
+		}
+	}
+	return b.String()
+}
+
+// parseSelector parses a label selector in the syntax of kubectl, such as
+// "app=web,tier!=db,env in (prod,staging)", into the matchLabels and
+// matchExpressions of a LabelSelector:
+//
+//	selector: {{- parseSelector .Values.selector | toYaml | nindent 2 }}
+//
+// Both keys are always present. Requirements other than equality become
+// expressions, sorted by key, with "!=" as the NotIn operator. An expression
+// for the Exists and DoesNotExist operators has no values.
+//
+// This is designed to be called from a template. Like fromYAML, it tolerates
+// errors: if selector cannot be parsed, the returned map only holds the error
+// message in m["Error"].
+func parseSelector(selector string) map[string]interface{} {
+	reqs, err := labels.ParseToRequirements(selector)
+	if err != nil {
+		return map[string]interface{}{"Error": fmt.Sprintf("invalid selector %q: %s", selector, err)}
+	}
+	matchLabels := map[string]interface{}{}
+	matchExpressions := []interface{}{}
+	for _, req := range reqs {
+		var op metav1.LabelSelectorOperator
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			matchLabels[req.Key()] = req.Values().List()[0]
+			continue
+		case selection.In:
+			op = metav1.LabelSelectorOpIn
+		case selection.NotIn, selection.NotEquals:
+			op = metav1.LabelSelectorOpNotIn
+		case selection.Exists:
+			op = metav1.LabelSelectorOpExists
+		case selection.DoesNotExist:
+			op = metav1.LabelSelectorOpDoesNotExist
+		default:
+			return map[string]interface{}{"Error": fmt.Sprintf("invalid selector %q: operator %q is not supported in label selectors", selector, req.Operator())}
+		}
+		expr := map[string]interface{}{"key": req.Key(), "operator": string(op)}
+		if values := req.Values().List(); len(values) > 0 {
+			list := make([]interface{}, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			expr["values"] = list
+		}
+		matchExpressions = append(matchExpressions, expr)
+	}
+	return map[string]interface{}{
+		"matchLabels":      matchLabels,
+		"matchExpressions": matchExpressions,
+	}
+}
+
+// b64decBytes decodes base64 encoded s into bytes, which unlike the string
+// returned by b64dec can hold binary data such as a DER certificate. It accepts
+// both the standard and the URL-safe alphabet, with or without padding, and
+// ignores whitespace, such as the line breaks of a wrapped value.
+//
+// A template prints the bytes as a list of numbers, such as [104 105], so the
+// result is only meant to be piped into a function that takes bytes, such as
+// b64encBytes to normalize the encoding, or toString for text:
+//
+//	ca.crt: {{ b64decBytes .Values.caBundle | b64encBytes }}
+//	motd: {{ b64decBytes .Values.motd | toString | quote }}
+func b64decBytes(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', '=':
+			return -1
+		case '-':
+			return '+'
+		case '_':
+			return '/'
+		}
+		return r
+	}, s)
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 input: %s", err)
+	}
+	return b, nil
+}
+
+// b32encoding is the base32 encoding of b32encLower and b32decLower: the
+// standard alphabet of RFC 4648 in lower case, without padding.
+var b32encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// b32encLower base32 encodes s in lower case without padding, so that the
+// result only holds the characters a-z and 2-7 and is safe in a DNS-1123
+// label, such as for a name derived from arbitrary text:
+//
+//	name: {{ printf "tenant-%s" (b32encLower .Values.tenant) | trunc 63 }}
+//
+// Sprig's b32enc, by contrast, encodes in upper case with padding.
+func b32encLower(s string) string {
+	return b32encoding.EncodeToString([]byte(s))
+}
+
+// b32decLower decodes s, base32 encoded in upper or lower case, with or
+// without padding. Unlike sprig's b32dec, invalid input is an error.
+func b32decLower(s string) (string, error) {
+	data, err := b32encoding.DecodeString(strings.ToLower(strings.TrimRight(s, "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid base32 data: %s", err)
+	}
+	return string(data), nil
+}
+
+// volatileMetadata lists the metadata fields the API server maintains on an
+// object. They are ignored by fingerprint.
+var volatileMetadata = []string{"creationTimestamp", "resourceVersion", "uid", "generation", "managedFields"}
+
+// fingerprint returns a SHA-256 hash of obj that ignores its status and the
+// metadata maintained by the API server, so that a desired object and the live
+// copy of it hash identically. obj is not modified.
+//
+// This is designed to be called from a template. It returns an empty string if
+// obj cannot be marshaled.
+func fingerprint(obj map[string]interface{}) string {
+	canonical := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k == "status" {
+			continue
+		}
+		canonical[k] = v
+	}
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		m := make(map[string]interface{}, len(metadata))
+		for k, v := range metadata {
+			m[k] = v
+		}
+		for _, k := range volatileMetadata {
+			delete(m, k)
+		}
+		canonical["metadata"] = m
+	}
+
+	// encoding/json sorts map keys, which makes the encoding canonical.
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cloneValues returns a deep copy of v, so that the copy can be modified in a
+// template without affecting v. Maps and slices are copied recursively, while
+// scalars and values of any other type are returned as they are.
+//
+// Unlike sprig's deepCopy it never fails, which makes it safe to use on any
+// part of .Values.
+func cloneValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case chartutil.Values:
+		return chartutil.Values(cloneMap(v))
+	case map[string]interface{}:
+		return cloneMap(v)
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			m[k] = cloneValues(item)
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = cloneValues(item)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+func cloneMap(v map[string]interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(v))
+	for k, item := range v {
+		m[k] = cloneValues(item)
+	}
+	return m
+}
+
+// webhookClientConfig returns the clientConfig of an admission webhook. The
+// webhook is reached through the Service service in namespace at path, or, if
+// service is empty, at the URL given as path:
+//
+//	clientConfig: {{ webhookClientConfig "my-webhook" .Release.Namespace "/validate" .Values.caBundle | toJson }}
+//
+// caBundle is the base64-encoded PEM bundle used to verify the certificate of
+// the webhook. Pass an empty caBundle when it is injected by another controller,
+// such as cert-manager's CA injector through the
+// "cert-manager.io/inject-ca-from" annotation, so that the field is left unset
+// for it to fill in.
+func webhookClientConfig(service, namespace, path, caBundle string) map[string]interface{} {
+	config := map[string]interface{}{}
+	if service == "" {
+		config["url"] = path
+	} else {
+		svc := map[string]interface{}{
+			"name":      service,
+			"namespace": namespace,
+		}
+		if path != "" {
+			svc["path"] = path
+		}
+		config["service"] = svc
+	}
+	if caBundle != "" {
+		config["caBundle"] = caBundle
+	}
+	return config
+}
+
+// urlPathUnescape decodes a URL path segment encoded with urlPathEscape. Unlike
+// urlQueryUnescape it leaves '+' as it is.
+//
+// This is designed to be called from a template. It returns s unchanged if it
+// is not a valid escaped string.
+func urlPathUnescape(s string) string {
+	u, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return u
+}
+
+// urlQueryUnescape decodes a URL query component encoded with urlQueryEscape,
+// turning '+' into a space.
+//
+// This is designed to be called from a template. It returns s unchanged if it
+// is not a valid escaped string.
+func urlQueryUnescape(s string) string {
+	u, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return u
+}
+
+// cidrHost returns the address of host n in the network cidr, counted from the
+// network address, such as the cluster DNS service at the tenth address of the
+// service CIDR:
+//
+//	clusterDNS: {{ cidrHost .Values.serviceCIDR 10 | quote }}
+//
+// Only usable hosts can be addressed: n must be at least 1 and, in an IPv4
+// network, the broadcast address is excluded. The exceptions are IPv4 /31 and
+// /32 networks, where every address is a host.
+func cidrHost(cidr string, n interface{}) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	host, err := toWholeNumber(n)
+	if err != nil {
+		return "", fmt.Errorf("invalid host number: %s", err)
+	}
+
+	ones, bits := network.Mask.Size()
+	first, last := big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last.Sub(last, big.NewInt(1))
+	if bits == 8*net.IPv4len {
+		if bits-ones < 2 {
+			first.SetInt64(0)
+		} else {
+			last.Sub(last, big.NewInt(1))
+		}
+	}
+	offset := big.NewInt(host)
+	if offset.Cmp(first) < 0 || offset.Cmp(last) > 0 {
+		return "", fmt.Errorf("host %d is out of range for %s, which has hosts %s to %s", host, cidr, first, last)
+	}
+
+	addr := new(big.Int).SetBytes(network.IP)
+	addr.Add(addr, offset)
+	return net.IP(addr.FillBytes(make([]byte, len(network.IP)))).String(), nil
+}
+
+// cidrContains reports whether the network cidr contains the address ip.
+func cidrContains(cidr, ip string) (bool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, fmt.Errorf("invalid IP address %q", ip)
+	}
+	return network.Contains(addr), nil
+}
+
+// rolloutControl returns the fragment that pauses or resumes a rollout. By
+// default it is the "paused" field of a Deployment spec:
+//
+//	spec:
+//	  {{- rolloutControl .Values.paused | toYaml | nindent 2 }}
+//
+// Progressive delivery controllers that are gated by an annotation instead are
+// selected by passing its name, in which case the result is an "annotations"
+// map holding "true" or "false" for the annotation:
+//
+//	metadata:
+//	  {{- rolloutControl .Values.paused "example.com/paused" | toYaml | nindent 2 }}
+func rolloutControl(paused bool, annotation ...string) (map[string]interface{}, error) {
+	switch len(annotation) {
+	case 0:
+		return map[string]interface{}{"paused": paused}, nil
+	case 1:
+		if annotation[0] == "" {
+			return nil, fmt.Errorf("rolloutControl: annotation name must not be empty")
+		}
+		return map[string]interface{}{
+			"annotations": map[string]interface{}{annotation[0]: strconv.FormatBool(paused)},
+		}, nil
+	default:
+		return nil, fmt.Errorf("rolloutControl: expected at most one annotation, got %d", len(annotation))
+	}
+}
+
+// durationSeconds converts a duration, such as "90s" or "1h30m", to a whole
+// number of seconds, as used by probe and grace period fields. A fraction of a
+// second is rounded up, so that "1500ms" is 2 and a short timeout never
+// becomes 0. Numbers are taken to be in seconds already.
+func durationSeconds(v interface{}) (int64, error) {
+	s, ok := v.(string)
+	if !ok {
+		n, err := toWholeNumber(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", err)
+		}
+		if n < 0 {
+			return 0, fmt.Errorf("invalid duration %d: must not be negative", n)
+		}
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %s", s, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q: must not be negative", s)
+	}
+	seconds := d / time.Second
+	if d%time.Second != 0 {
+		seconds++
+	}
+	return int64(seconds), nil
+}
+
+// requireTogether fails unless either all or none of the dotted keys are set
+// in values, for options that only work as a group:
+//
+//	{{- requireTogether .Values "tls.cert" "tls.key" "tls.ca" }}
+//
+// A key is set if it holds a value other than null or an empty string. This is
+// designed to be called from a template, where it renders as an empty string.
+func requireTogether(values map[string]interface{}, keys ...string) (string, error) {
+	var set, missing []string
+	for _, key := range keys {
+		v := valueAt(values, key)
+		if v == nil || v == "" {
+			missing = append(missing, key)
+		} else {
+			set = append(set, key)
+		}
+	}
+	if len(set) > 0 && len(missing) > 0 {
+		return "", fmt.Errorf("%s must be set together: %s set but %s not", strings.Join(keys, ", "), strings.Join(set, ", "), strings.Join(missing, ", "))
+	}
+	return "", nil
+}
+
+// coalesceEmpty returns the first of its arguments that is not empty, or nil if
+// they all are. It is like sprig's coalesce, except that a string holding only
+// whitespace is empty too. Other values are empty as they are for coalesce:
+// nil, false, zero numbers and empty collections.
+func coalesceEmpty(v ...interface{}) interface{} {
+	for _, val := range v {
+		if s, ok := val.(string); ok {
+			if strings.TrimSpace(s) != "" {
+				return val
+			}
+			continue
+		}
+		if truth, ok := template.IsTrue(val); ok && truth {
+			return val
+		}
+	}
+	return nil
+}
+
+// kustomization returns a kustomization.yaml that lists the resources, the
+// file names of the manifests, in sorted order, and applies the namespace and
+// commonLabels to them. An empty namespace or commonLabels is left out.
+//
+// This is designed to be called from a template, such as one generating a
+// Kustomize base for downstream overlays.
+func kustomization(resources []interface{}, namespace string, commonLabels map[string]interface{}) string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		names = append(names, fmt.Sprint(r))
+	}
+	sort.Strings(names)
+
+	k := map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  names,
+	}
+	if namespace != "" {
+		k["namespace"] = namespace
+	}
+	if len(commonLabels) > 0 {
+		labels := make(map[string]string, len(commonLabels))
+		for key, v := range commonLabels {
+			labels[key] = fmt.Sprint(v)
+		}
+		k["commonLabels"] = labels
+	}
+	return toYAML(k)
+}
+
+// replaceLiteral replaces every occurrence of old in input with new. Unlike
+// regexReplaceAll, new is used verbatim, so that "$1" or "${name}" in a
+// password is not taken for a reference to a capture group:
+//
+//	{{ .Files.Get "config.ini" | replaceLiteral "@PASSWORD@" .Values.password }}
+func replaceLiteral(old, new, input string) string {
+	return strings.ReplaceAll(input, old, new)
+}
+
+// reindent parses block as one or more YAML documents and writes them out again
+// with a uniform indentation of two spaces per level, indenting every line by
+// spaces. Unlike nindent, it fixes inconsistent indentation within block, such
+// as in fragments produced by other tools. The order of keys, comments and the
+// style of scalars are kept. If block does not parse because of tabs in its
+// indentation, which YAML does not allow, the tabs are taken as tab stops
+// every eight columns.
+//
+//	data:
+//	{{ .Files.Get "generated.yaml" | reindent 2 }}
+//
+// This is designed to be called from a template. It returns block unchanged if
+// it is not valid YAML.
+func reindent(spaces int, block string) string {
+	out, err := reencodeYAML(block)
+	if err != nil {
+		if out, err = reencodeYAML(expandIndentTabs(block)); err != nil {
+			return block
+		}
+	}
+
+	// Document separators stay at the start of the line, where they have to
+	// be to separate the documents.
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" && line != "---" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reencodeYAML parses the YAML documents in block and encodes them again with
+// an indentation of two spaces.
+func reencodeYAML(block string) (string, error) {
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	dec := yamlv3.NewDecoder(strings.NewReader(block))
+	for {
+		var doc yamlv3.Node
+		if err := dec.Decode(&doc); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		if err := enc.Encode(&doc); err != nil {
+			return "", err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// expandIndentTabs replaces the tabs in the indentation of the lines of block
+// with spaces up to the next tab stop, every eight columns.
+func expandIndentTabs(block string) string {
+	lines := strings.Split(block, "\n")
+	for i, line := range lines {
+		var indent strings.Builder
+		j := 0
+		for ; j < len(line) && (line[j] == ' ' || line[j] == '\t'); j++ {
+			if line[j] == ' ' {
+				indent.WriteByte(' ')
+				continue
+			}
+			indent.WriteString(strings.Repeat(" ", 8-indent.Len()%8))
+		}
+		lines[i] = indent.String() + line[j:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// toRFC3339 formats a time, such as the result of now, as an RFC 3339
+// timestamp in UTC, so that the output does not depend on the time zone of the
+// machine rendering the chart. Integers are taken as Unix timestamps.
+//
+// This is designed to be called from a template. It returns an empty string
+// for values of any other type.
+func toRFC3339(v interface{}) string {
+	t, ok := asTime(v)
+	if !ok {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// asTime converts v into a time.Time as toRFC3339 does.
+func asTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case *time.Time:
+		if v == nil {
+			return time.Time{}, false
+		}
+		return *v, true
+	case int:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	case int32:
+		return time.Unix(int64(v), 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// parseRFC3339 parses an RFC 3339 timestamp, such as "2022-06-01T12:00:00+02:00",
+// and returns the time in UTC.
+//
+// This is designed to be called from a template. It returns the zero time if s
+// is not a valid timestamp, which can be checked with its IsZero method.
+func parseRFC3339(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// timestampLabelLayout is an ISO 8601 layout without the colons and upper
+// case letters that label values cannot hold.
+const timestampLabelLayout = "2006-01-02t15-04-05z"
+
+// timestampLabel formats a time like toRFC3339, but as a valid label value,
+// such as "2022-06-01t10-00-00z", that still sorts in time order:
+//
+//	app.example.com/deployed-at: {{ now | timestampLabel }}
+//
+// This is designed to be called from a template. It returns an empty string
+// for values that are not a time or an integer.
+func timestampLabel(v interface{}) string {
+	t, ok := asTime(v)
+	if !ok {
+		return ""
+	}
+	return t.UTC().Format(timestampLabelLayout)
+}
+
+// filterIn returns the items of list whose key field equals any of values, in
+// the order they appear in list:
+//
+//	{{- range filterIn "tier" (list "frontend" "backend") .Values.services }}
+//
+// The items can be maps or structs. Items that are not, or lack the key, are
+// left out. If values is empty, nothing is returned.
+func filterIn(key string, values []interface{}, list interface{}) ([]interface{}, error) {
+	return doFilter(list, func(item interface{}) bool {
+		v, ok := fieldValue(item, key)
+		if !ok {
+			return false
+		}
+		for _, want := range values {
+			if looseEqual(v, want) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// filterOps are the comparison operators of filterOp, by the result of
+// compareValues they accept.
+var filterOps = map[string]func(int) bool{
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+// filterOp returns the items of list whose key field compares to value with
+// op, one of ==, !=, <, <=, > and >=, in the order they appear in list:
+//
+//	{{- range filterOp "replicas" ">" 3 .Values.deployments }}
+//
+// Numbers are compared by value, whatever their type, and strings
+// lexically. Other values can only be compared with == and !=, and only to
+// values of the same type. Comparing values of incompatible types is an error.
+// Like filterIn, items that are not maps or structs, or lack the key, are left
+// out.
+func filterOp(key, op string, value interface{}, list interface{}) ([]interface{}, error) {
+	accept, ok := filterOps[op]
+	if !ok {
+		return nil, fmt.Errorf("filterOp: unknown operator %q", op)
+	}
+	var err error
+	out, ferr := doFilter(list, func(item interface{}) bool {
+		v, ok := fieldValue(item, key)
+		if !ok || err != nil {
+			return false
+		}
+		var c int
+		c, err = compareValues(v, value, op == "==" || op == "!=")
+		return err == nil && accept(c)
+	})
+	if ferr != nil {
+		return nil, ferr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filterOp: cannot compare field %q: %s", key, err)
+	}
+	return out, nil
+}
+
+// compareValues returns -1, 0 or 1 as a is less than, equal to or greater
+// than b. Numbers and strings are ordered. If equality is true, any other
+// values of the same type are compared for equality only, with 1 for unequal
+// values.
+func compareValues(a, b interface{}, equality bool) (int, error) {
+	fa, aok := asFloat(a)
+	fb, bok := asFloat(b)
+	switch {
+	case aok && bok:
+		switch {
+		case fa < fb:
+			return -1, nil
+		case fa > fb:
+			return 1, nil
+		}
+		return 0, nil
+	case aok || bok:
+		return 0, fmt.Errorf("%v (%T) and %v (%T) are not both numbers", a, a, b, b)
+	}
+	sa, aok := a.(string)
+	sb, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(sa, sb), nil
+	}
+	if equality && a != nil && b != nil && reflect.TypeOf(a) == reflect.TypeOf(b) {
+		if reflect.DeepEqual(a, b) {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("cannot compare %v (%T) and %v (%T)", a, a, b, b)
+}
+
+// sortBy returns the items of list sorted in ascending order by their key
+// field, keeping the order of items with equal values:
+//
+//	{{- range sortBy "containerPort" .Values.ports }}
+//
+// The items can be maps or structs, with numbers compared by value and strings
+// lexically. Items that are not, or lack the key, are placed last, in the
+// order they appear in list. Values that cannot be compared, such as a number
+// and a string, are an error.
+func sortBy(key string, list interface{}) ([]interface{}, error) {
+	items, err := listItems(list)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]interface{}, 0, len(items))
+	var values, missing []interface{}
+	for _, item := range items {
+		if v, ok := fieldValue(item, key); ok {
+			sorted = append(sorted, item)
+			values = append(values, v)
+		} else {
+			missing = append(missing, item)
+		}
+	}
+
+	// Sort the indices, so that the items and their values stay paired.
+	order := make([]int, len(sorted))
+	for i := range order {
+		order[i] = i
+	}
+	var cmpErr error
+	sort.SliceStable(order, func(i, j int) bool {
+		c, err := compareValues(values[order[i]], values[order[j]], false)
+		if err != nil && cmpErr == nil {
+			cmpErr = err
+		}
+		return c < 0
+	})
+	if cmpErr != nil {
+		return nil, fmt.Errorf("sortBy: cannot compare field %q: %s", key, cmpErr)
+	}
+	out := make([]interface{}, 0, len(items))
+	for _, i := range order {
+		out = append(out, sorted[i])
+	}
+	return append(out, missing...), nil
+}
+
+// uniqBy returns the items of list with duplicates by the key field removed,
+// keeping the first item with each value of the field, in the order they appear
+// in list:
+//
+//	ports: {{- toYaml (uniqBy "port" .Values.ports) | nindent 2 }}
+//
+// The items can be maps or structs. Items that are not, or lack the key, are
+// all kept.
+func uniqBy(key string, list interface{}) ([]interface{}, error) {
+	var seen []interface{}
+	return doFilter(list, func(item interface{}) bool {
+		v, ok := fieldValue(item, key)
+		if !ok {
+			return true
+		}
+		for _, s := range seen {
+			if looseEqual(v, s) {
+				return false
+			}
+		}
+		seen = append(seen, v)
+		return true
+	})
+}
+
+// doFilter returns the items of list, a slice or an array, for which keep
+// returns true.
+func doFilter(list interface{}, keep func(interface{}) bool) ([]interface{}, error) {
+	items, err := listItems(list)
+	if err != nil {
+		return nil, err
+	}
+	out := []interface{}{}
+	for _, item := range items {
+		if keep(item) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+// setUnion returns the strings that are in any of lists, sorted and without
+// duplicates:
+//
+//	allowedOrigins: {{ setUnion .Values.origins .Values.extraOrigins | toJson }}
+//
+// The lists can be slices of strings or of other values, such as the numbers
+// of a values file, which are converted to strings as toEnvList does. The same
+// applies to setIntersect and setDifference.
+func setUnion(lists ...interface{}) ([]string, error) {
+	sets, err := stringSets(lists)
+	if err != nil {
+		return nil, err
+	}
+	union := map[string]bool{}
+	for _, set := range sets {
+		for s := range set {
+			union[s] = true
+		}
+	}
+	return sortedKeys(union), nil
+}
+
+// setIntersect returns the strings that are in every one of lists, sorted and
+// without duplicates.
+func setIntersect(lists ...interface{}) ([]string, error) {
+	sets, err := stringSets(lists)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return []string{}, nil
+	}
+	intersection := map[string]bool{}
+	for s := range sets[0] {
+		intersection[s] = true
+		for _, set := range sets[1:] {
+			if !set[s] {
+				delete(intersection, s)
+				break
+			}
+		}
+	}
+	return sortedKeys(intersection), nil
+}
+
+// setDifference returns the strings of list that are in none of others, sorted
+// and without duplicates:
+//
+//	{{- range setDifference .Values.features .Values.disabledFeatures }}
+func setDifference(list interface{}, others ...interface{}) ([]string, error) {
+	sets, err := stringSets(append([]interface{}{list}, others...))
+	if err != nil {
+		return nil, err
+	}
+	difference := sets[0]
+	for _, set := range sets[1:] {
+		for s := range set {
+			delete(difference, s)
+		}
+	}
+	return sortedKeys(difference), nil
+}
+
+// stringSets converts each of lists into a set of strings.
+func stringSets(lists []interface{}) ([]map[string]bool, error) {
+	sets := make([]map[string]bool, len(lists))
+	for i, list := range lists {
+		items, err := listItems(list)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = make(map[string]bool, len(items))
+		for _, item := range items {
+			sets[i][envValue(item)] = true
+		}
+	}
+	return sets, nil
+}
+
+// sortedKeys returns the members of set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listItems returns the items of list, which must be a slice or an array. A nil
+// list has no items.
+func listItems(list interface{}) ([]interface{}, error) {
+	if list == nil {
+		return nil, nil
+	}
+	if items, ok := list.([]interface{}); ok {
+		return items, nil
+	}
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("cannot iterate over %T", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// fieldValue returns the value of the field key of item, which can be a map
+// with string keys, a struct or a pointer to either. Nested fields are not
+// looked up.
+func fieldValue(item interface{}, key string) (interface{}, bool) {
+	v := reflect.ValueOf(item)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		f := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if !f.IsValid() {
+			return nil, false
+		}
+		return f.Interface(), true
+	case reflect.Struct:
+		f := v.FieldByName(key)
+		if !f.IsValid() || !f.CanInterface() {
+			return nil, false
+		}
+		return f.Interface(), true
+	default:
+		return nil, false
+	}
+}
+
+// looseEqual reports whether a and b are equal, treating numbers of different
+// types as equal if they have the same value, since values files yield float64
+// where templates use int.
+func looseEqual(a, b interface{}) bool {
+	fa, aok := asFloat(a)
+	fb, bok := asFloat(b)
+	if aok && bok {
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// toBool interprets v as a boolean the way users write one in values or
+// environment variables:
+//
+//	{{- if toBool .Values.metrics.enabled }}
+//
+// Booleans are returned as they are. The strings "true", "yes", "y", "on" and
+// "1" are true, and "false", "no", "n", "off" and "0" are false, in any case
+// and with surrounding whitespace ignored. The numbers 1 and 0 are true and
+// false. A missing value and an empty string are false. Any other value is an
+// error, so that a typo such as "ture" fails the render instead of being
+// taken for either.
+func toBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "yes", "y", "on", "1":
+			return true, nil
+		case "false", "no", "n", "off", "0", "":
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot interpret %q as a boolean", v)
+	}
+	if f, ok := asFloat(v); ok {
+		switch f {
+		case 1:
+			return true, nil
+		case 0:
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cannot interpret %v as a boolean", v)
+}
+
+// toKebab converts an identifier such as "HTTPServer" or "parseURL" to kebab
+// case, "http-server" and "parse-url". Unlike sprig's kebabcase, it keeps
+// acronyms together.
+func toKebab(s string) string {
+	return strings.Join(identifierWords(s), "-")
+}
+
+// toSnake converts an identifier such as "HTTPServer" or "parseURL" to snake
+// case, "http_server" and "parse_url". Unlike sprig's snakecase, it keeps
+// acronyms together.
+func toSnake(s string) string {
+	return strings.Join(identifierWords(s), "_")
+}
+
+// identifierWords splits an identifier into lowercase words. Words are
+// separated by any character other than a letter or a digit, and start at an
+// upper case letter that follows a lower case letter or a digit, as in "myID",
+// or that is followed by a lower case letter after an acronym, as the "S" in
+// "HTTPServer".
+func identifierWords(s string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(s)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && len(word) > 0 {
+			prev := word[len(word)-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
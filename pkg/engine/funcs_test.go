@@ -17,11 +17,21 @@ limitations under the License.
 package engine
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	yamlv3 "gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"helm.sh/helm/v3/pkg/chartutil"
 )
 
 func TestFuncs(t *testing.T) {
@@ -78,6 +88,14 @@ func TestFuncs(t *testing.T) {
 		tpl:    `{{ fromJsonArray . }}`,
 		expect: `[json: cannot unmarshal object into Go value of type []interface {}]`,
 		vars:   `{"hello": "world"}`,
+	}, {
+		tpl:    `{{ mustFromJson . }}`,
+		expect: `map[hello:world]`,
+		vars:   `{"hello":"world"}`,
+	}, {
+		tpl:    `{{ mustFromJsonArray . }}`,
+		expect: `[one 2 map[name:helm]]`,
+		vars:   `["one", 2, { "name": "helm" }]`,
 	}, {
 		tpl:    `{{ merge .dict (fromYaml .yaml) }}`,
 		expect: `map[a:map[b:c]]`,
@@ -99,6 +117,99 @@ func TestFuncs(t *testing.T) {
 		tpl:    `{{ lookup "v1" "Namespace" "" "unlikelynamespace99999999" }}`,
 		expect: `map[]`,
 		vars:   `["one", "two"]`,
+	}, {
+		// Like lookup, lookupList should never result in a network lookup.
+		tpl:    `{{ lookupList "v1" "Pod" "default" "app=web" }}`,
+		expect: `[]`,
+		vars:   nil,
+	}, {
+		tpl:    `{{ range lookupList "v1" "Pod" "" "" }}{{ .metadata.name }}{{ else }}none{{ end }}`,
+		expect: `none`,
+		vars:   nil,
+	}, {
+		tpl:    `{{ lookupWithSelector "v1" "Pod" "default" "status.phase=Running" }}`,
+		expect: `map[]`,
+		vars:   nil,
+	}, {
+		tpl:    `{{ toEnvList . }}`,
+		expect: "- name: \"DEBUG\"\n  value: \"true\"\n- name: \"PORT\"\n  value: \"8080\"\n- name: \"REPLICAS\"\n  value: \"1000000\"",
+		vars:   map[string]interface{}{"PORT": 8080, "DEBUG": true, "REPLICAS": float64(1000000)},
+	}, {
+		tpl:    `{{ toEnvList . }}`,
+		expect: `[]`,
+		vars:   map[string]interface{}{},
+	}, {
+		tpl:    `{{ toEnvList . | fromYamlArray }}`,
+		expect: `[map[name:GREETING value:hello world] map[name:PORT value:8080]]`,
+		vars:   map[string]interface{}{"PORT": 8080, "GREETING": "hello world"},
+	}, {
+		tpl:    `{{ b64encBytes . }}`,
+		expect: `aGVsbG8sIHdvcmxk`,
+		vars:   []byte("hello, world"),
+	}, {
+		tpl:    `{{ b64encBytes . | b64dec }}`,
+		expect: "\x00\x01binary\xff",
+		vars:   []byte("\x00\x01binary\xff"),
+	}, {
+		tpl:    `{{ cpuToNanos "250m" }} {{ nanosToCpu 250000000 }}`,
+		expect: `250000000 250m`,
+		vars:   nil,
+	}, {
+		tpl:    `{{ memoryToBytes "1Gi" }} {{ bytesToMemory 1073741824 }}`,
+		expect: `1073741824 1Gi`,
+		vars:   nil,
+	}, {
+		tpl:    `{{ $m := fromYamlStrict . }}{{ $m.replicas }} {{ $m.a.b.c.d }} {{ hasKey $m "Error" }}`,
+		expect: `2 deep false`,
+		vars:   "replicas: 2\na:\n  b:\n    c:\n      d: deep\n      unknown: [1, 2]\n",
+	}, {
+		tpl:    `{{ $m := fromYamlStrict . }}{{ hasKey $m "Error" }}`,
+		expect: `true`,
+		vars:   "replicas: 2\nimage: nginx\nreplicas: 3\n",
+	}, {
+		tpl:    `{{ $m := fromYamlStrict . }}{{ hasKey $m "Error" }}`,
+		expect: `true`,
+		vars:   "a:\n  b: 1\n  b: 2\n",
+	}, {
+		tpl:    `{{ $m := fromYaml . }}{{ $m.replicas }}`,
+		expect: `3`,
+		vars:   "replicas: 2\nimage: nginx\nreplicas: 3\n",
+	}, {
+		tpl:    `{{ printf "%s-%s" .Release "Web_Frontend" | toDNS1123 }}`,
+		expect: `prod-web-frontend`,
+		vars:   map[string]interface{}{"Release": "Prod"},
+	}, {
+		tpl:    `{{ toCsv . }}`,
+		expect: "host,port\n\"db,primary\",5432\n\"say \"\"hi\"\"\",\"multi\nline\"",
+		vars:   []interface{}{[]interface{}{"host", "port"}, []interface{}{"db,primary", 5432}, []string{`say "hi"`, "multi\nline"}},
+	}, {
+		tpl:    `{{ toCsv . }}`,
+		expect: "a,b\nc,d",
+		vars:   [][]string{{"a", "b"}, {"c", "d"}},
+	}, {
+		tpl:    `{{ toCsv . }}`,
+		expect: "",
+		vars:   []interface{}{"not a row"},
+	}, {
+		tpl:    `{{ range fromCsv . }}[{{ join "|" . }}]{{ end }}`,
+		expect: "[host|port][db,primary|5432][say \"hi\"|multi\nline]",
+		vars:   "host,port\n\"db,primary\",5432\n\"say \"\"hi\"\"\",\"multi\nline\"\n",
+	}, {
+		tpl:    `{{ fromCsv . | toCsv }}`,
+		expect: "\"a,b\",\"c\"\"d\"",
+		vars:   "\"a,b\",\"c\"\"d\"",
+	}, {
+		tpl:    `{{ fromCsv . }}`,
+		expect: `[[record on line 2: wrong number of fields]]`,
+		vars:   "a,b\nc\n",
+	}, {
+		tpl:    `{{ archImage .image "arm64" }}`,
+		expect: `ghcr.io/example/app:1.0.0-arm64`,
+		vars:   map[string]interface{}{"image": "ghcr.io/example/app:1.0.0"},
+	}, {
+		tpl:    `{{ isValidYaml "a: [1, 2" }} {{ isValidYaml "a: [1, 2]" }}`,
+		expect: `false true`,
+		vars:   nil,
 	}}
 
 	for _, tt := range tests {
@@ -176,3 +287,2292 @@ func TestMerge(t *testing.T) {
 	}
 	assert.Equal(t, expected, dict["dst"])
 }
+
+func TestChartSemverMatch(t *testing.T) {
+	tests := []struct {
+		constraint, version string
+		expect              bool
+	}{
+		{">=1.0.0", "1.2.3", true},
+		{">=1.0.0", "0.9.0", false},
+		// Pre-releases are excluded unless the constraint opts in.
+		{">=1.0.0", "1.1.0-beta.1", false},
+		{">=1.0.0-0", "1.1.0-beta.1", true},
+		{"^1.2.0", "1.9.9", true},
+		{"~1.2.0", "1.3.0", false},
+		{"1.0.0 - 2.0.0", "1.5.0", true},
+		// An exact match always wins, as in `helm install --version`.
+		{"1.0.0-rc.1", "1.0.0-rc.1", true},
+		// An empty constraint matches any release, as in the repository index.
+		{"", "1.2.3", true},
+		{"", "1.2.3-alpha", false},
+		// Versions that are not semver never match.
+		{">=1.0.0", "latest", false},
+	}
+
+	for _, tt := range tests {
+		got, err := chartSemverMatch(tt.constraint, tt.version)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, got, "%q %q", tt.constraint, tt.version)
+	}
+
+	// As in the repository index, the constraint must be valid even when the
+	// version is string-equal to it.
+	for _, constraint := range []string{">=foo", "latest"} {
+		_, err := chartSemverMatch(constraint, "latest")
+		assert.Error(t, err, constraint)
+	}
+
+	// Where the rules of the repository index differ from those of
+	// semverCompare, semverCompare fails the render.
+	for _, tt := range []struct {
+		constraint, version string
+		expect              string
+	}{
+		{"", "1.2.3", "true"},
+		{"", "1.2.3-alpha", "false"},
+		{">=1.0.0", "latest", "false"},
+	} {
+		var b strings.Builder
+		tpl := fmt.Sprintf(`{{ chartSemverMatch %q %q }}`, tt.constraint, tt.version)
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, b.String(), tpl)
+
+		b.Reset()
+		tpl = fmt.Sprintf(`{{ semverCompare %q %q }}`, tt.constraint, tt.version)
+		err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+		assert.Error(t, err, tpl)
+	}
+}
+
+func TestSemverParts(t *testing.T) {
+	assert.Equal(t, 1, semverMajor("v1.22.3"))
+	assert.Equal(t, 22, semverMinor("v1.22.3"))
+	assert.Equal(t, 3, semverPatch("v1.22.3"))
+	assert.Equal(t, "", semverPrerelease("v1.22.3"))
+
+	// Build metadata is not part of the pre-release.
+	assert.Equal(t, 2, semverMajor("2.0.1-rc.1+build.5"))
+	assert.Equal(t, 0, semverMinor("2.0.1-rc.1+build.5"))
+	assert.Equal(t, 1, semverPatch("2.0.1-rc.1+build.5"))
+	assert.Equal(t, "rc.1", semverPrerelease("2.0.1-rc.1+build.5"))
+
+	for _, f := range []func(string) interface{}{semverMajor, semverMinor, semverPatch, semverPrerelease} {
+		got, ok := f("latest").(string)
+		assert.True(t, ok)
+		assert.Contains(t, got, `invalid version "latest"`)
+	}
+
+	var b strings.Builder
+	tpl := `{{ if ge (semverMajor .) 2 }}v2{{ end }} {{ semverMinor . }} {{ semverPrerelease . }}`
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, "2.5.0-beta.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2 5 beta.1", b.String())
+}
+
+func TestIsValidResource(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    map[string]interface{}
+		valid  bool
+		reason string
+	}{{
+		name: "valid",
+		obj: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "cm"},
+		},
+		valid: true,
+	}, {
+		name: "missing apiVersion",
+		obj: map[string]interface{}{
+			"kind":     "ConfigMap",
+			"metadata": map[string]interface{}{"name": "cm"},
+		},
+		reason: "missing apiVersion",
+	}, {
+		name: "missing kind",
+		obj: map[string]interface{}{
+			"apiVersion": "v1",
+			"metadata":   map[string]interface{}{"name": "cm"},
+		},
+		reason: "missing kind",
+	}, {
+		name: "missing metadata",
+		obj: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+		},
+		reason: "missing metadata",
+	}, {
+		name: "missing metadata.name",
+		obj: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"namespace": "default"},
+		},
+		reason: "missing metadata.name",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, reason := isValidResource(tt.obj)
+			assert.Equal(t, tt.valid, valid)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+
+	tpl := `{{ isValidResource (fromYaml .) }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: s\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", b.String())
+
+	tpl = `{{ validateResource (fromYaml .) | toYaml }}`
+	b.Reset()
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, "apiVersion: v1\nkind: Secret\n")
+	assert.EqualError(t, err, `template: test:1:3: executing "test" at <validateResource (fromYaml .)>: error calling validateResource: invalid resource: missing metadata`)
+}
+
+func TestLookupWithSelectorValidation(t *testing.T) {
+	tests := []struct {
+		selector string
+		valid    bool
+	}{
+		{"", true},
+		{"status.phase=Running", true},
+		{"status.phase!=Failed,spec.nodeName=node-1", true},
+		{"status.phase", false},
+		{"status.phase in (Running)", false},
+	}
+
+	for _, tt := range tests {
+		tpl := `{{ lookupWithSelector "v1" "Pod" "default" . }}`
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, tt.selector)
+		if tt.valid {
+			assert.NoError(t, err, tt.selector)
+			assert.Equal(t, "map[]", b.String())
+		} else {
+			assert.Error(t, err, tt.selector)
+		}
+	}
+}
+
+func TestReadinessGate(t *testing.T) {
+	tpl := `{{ list (readinessGate "www.example.com/feature-1") | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "- conditionType: www.example.com/feature-1", b.String())
+
+	_, err = readinessGate("Not A Condition!")
+	assert.Error(t, err)
+
+	_, err = readinessGate("")
+	assert.Error(t, err)
+}
+
+func TestToYAMLNulls(t *testing.T) {
+	vals := map[string]interface{}{
+		"image":     "nginx",
+		"resources": nil,
+		"nested": map[string]interface{}{
+			"limits":      map[string]interface{}(nil),
+			"tolerations": []interface{}(nil),
+		},
+		"values": chartutil.Values{"affinity": nil},
+	}
+	expect := `image: nginx
+nested:
+  limits: null
+  tolerations: null
+resources: null
+values:
+  affinity: null`
+
+	tpl := `{{ toYaml . }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, vals)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, b.String())
+
+	// The nulls survive a round trip.
+	m := fromYAML(b.String())
+	assert.NotContains(t, m, "Error")
+	assert.Contains(t, m, "resources")
+	assert.Nil(t, m["resources"])
+	assert.Equal(t, expect, toYAML(m))
+}
+
+func TestSHA256SumAll(t *testing.T) {
+	a, b, c := "replicas: 1\n", "image: nginx\n", strings.Repeat("x", 1<<20)
+
+	sum := sha256sumAll(a, b, c)
+	assert.Len(t, sum, 64)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, sum, sha256sumAll(a, b, c))
+	}
+	assert.Equal(t, sum, sha256sumAll(c, a, b))
+	assert.Equal(t, sum, sha256sumAll(b, c, a))
+
+	assert.NotEqual(t, sum, sha256sumAll(a, b))
+	assert.NotEqual(t, sum, sha256sumAll(a, b, c+"y"))
+	// Contents are not concatenated, so moving bytes between them matters.
+	assert.NotEqual(t, sha256sumAll("ab", "c"), sha256sumAll("a", "bc"))
+
+	tpl := `{{ sha256sumAll .b .a }}`
+	var out strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&out, map[string]string{"a": a, "b": b})
+	assert.NoError(t, err)
+	// A fixed value guards against the scheme changing between releases,
+	// which would roll every workload using it.
+	assert.Equal(t, "438937f6aaf8b838f58d0c6b34ad9d4b57b7df25bc871989d6883fb742d11800", out.String())
+}
+
+func TestArchImage(t *testing.T) {
+	digest := "nginx@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31"
+	for _, tt := range []struct {
+		ref, arch, expect string
+	}{
+		{"nginx:1.25", "amd64", "nginx:1.25-amd64"},
+		{"nginx:1.25", "arm64", "nginx:1.25-arm64"},
+		{"nginx", "s390x", "nginx:latest-s390x"},
+		{"registry.example.com:5000/team/app:v2", "ppc64le", "registry.example.com:5000/team/app:v2-ppc64le"},
+		{"registry.example.com:5000/team/app", "arm", "registry.example.com:5000/team/app:latest-arm"},
+		{"nginx:1.25-arm64", "arm64", "nginx:1.25-arm64"},
+		{digest, "arm64", digest},
+		{"nginx:1.25@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31", "amd64", "nginx:1.25@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31"},
+	} {
+		got, err := archImage(tt.ref, tt.arch)
+		assert.NoError(t, err, tt.ref)
+		assert.Equal(t, tt.expect, got, tt.ref)
+	}
+
+	_, err := archImage("nginx:1.25", "sparc")
+	assert.Error(t, err)
+	_, err = archImage("nginx:1.25-arm", "arm64")
+	assert.Error(t, err)
+}
+
+func TestIsValidYAML(t *testing.T) {
+	for _, tt := range []struct {
+		name, doc, msg string
+	}{
+		{"valid", "a:\n  b: 1\n  c: [1, 2]\n", ""},
+		{"tab indentation", "a:\n\tb: 1\n", "found character that cannot start any token"},
+		{"mis-nested key", "a:\n  b: 1\n   c: 2\n", "line 3: mapping values are not allowed in this context"},
+		{"dedented sequence item", "a:\n  - 1\n - 2\n", "line 2: did not find expected key"},
+		{"duplicate key", "a: 1\nb: 2\na: 3\n", `key "a" already set in map`},
+	} {
+		ok, msg := isValidYAML(tt.doc)
+		assert.Equal(t, tt.msg == "", ok, tt.name)
+		assert.Contains(t, msg, tt.msg, tt.name)
+	}
+
+	tpl := `{{ validateYaml .config | fromYaml | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"config": "a:\n  b: 1\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":{"b":1}}`, b.String())
+
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"config": "a:\n\tb: 1\n"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid YAML: yaml: line 2")
+	}
+}
+
+func TestPriorityClass(t *testing.T) {
+	tpl := `{{ priorityClassRef "high-priority" | toYaml }}
+---
+{{ priorityClass "high-priority" 1000 | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `priorityClassName: high-priority
+---
+apiVersion: scheduling.k8s.io/v1
+kind: PriorityClass
+metadata:
+  name: high-priority
+value: 1000`, b.String())
+
+	for _, name := range []string{"", "High-Priority", "high_priority", strings.Repeat("a", 254)} {
+		_, err = priorityClassRef(name)
+		assert.Error(t, err, name)
+		_, err = priorityClass(name, 1000)
+		assert.Error(t, err, name)
+	}
+
+	_, err = priorityClass("too-high", 1000000001)
+	assert.Error(t, err)
+	_, err = priorityClass("too-low", -2000000001)
+	assert.Error(t, err)
+}
+
+func TestLifecycleHook(t *testing.T) {
+	tpl := `{{ lifecycleHook "preStop" (dict "exec" (dict "command" (list "sh" "-c" "sleep 5"))) | toYaml }}
+---
+{{ lifecycleHook "postStart" (dict "httpGet" (dict "path" "/warmup" "port" 8080)) | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `preStop:
+  exec:
+    command:
+    - sh
+    - -c
+    - sleep 5
+---
+postStart:
+  httpGet:
+    path: /warmup
+    port: 8080`, b.String())
+
+	for _, tt := range []struct {
+		kind string
+		spec map[string]interface{}
+	}{
+		{"preStart", map[string]interface{}{"exec": map[string]interface{}{"command": []interface{}{"true"}}}},
+		{"preStop", map[string]interface{}{}},
+		{"preStop", map[string]interface{}{"exec": map[string]interface{}{}}},
+		{"preStop", map[string]interface{}{"exec": "sleep 5"}},
+		{"postStart", map[string]interface{}{"tcpSocket": map[string]interface{}{"host": "localhost"}}},
+		{"postStart", map[string]interface{}{"grpc": map[string]interface{}{"port": 9090}}},
+		{"postStart", map[string]interface{}{
+			"exec":    map[string]interface{}{"command": []interface{}{"true"}},
+			"httpGet": map[string]interface{}{"port": 8080},
+		}},
+	} {
+		_, err := lifecycleHook(tt.kind, tt.spec)
+		assert.Error(t, err, "%s %v", tt.kind, tt.spec)
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	tpl := `{{ hostPath "/var/run/docker.sock" "Socket" | toJson }} {{ hostPath "/var/log/" "" | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"path":"/var/run/docker.sock","type":"Socket"} {"path":"/var/log"}`, b.String())
+
+	_, err = hostPath("var/log", "Directory")
+	assert.EqualError(t, err, `invalid host path "var/log": must be absolute`)
+	_, err = hostPath("/var/log", "Folder")
+	assert.Error(t, err)
+}
+
+func TestToDNS1123(t *testing.T) {
+	for in, expect := range map[string]string{
+		"My-Release":                   "my-release",
+		"my_release.v2":                "my-release-v2",
+		"Café Über":                    "caf-ber",
+		"1st-release":                  "1st-release",
+		"--release--":                  "release",
+		"a__b  c":                      "a-b-c",
+		strings.Repeat("a", 62) + "-b": strings.Repeat("a", 62),
+		strings.Repeat("a", 70):        strings.Repeat("a", 63),
+	} {
+		got := toDNS1123(in)
+		assert.Equal(t, expect, got, in)
+		assert.Empty(t, validation.IsDNS1123Label(got), got)
+	}
+
+	// Input without a single valid character still produces a valid,
+	// deterministic label.
+	for _, in := range []string{"", "!!!", "ßü"} {
+		got := toDNS1123(in)
+		assert.Empty(t, validation.IsDNS1123Label(got), "%q produced %q", in, got)
+		assert.Equal(t, got, toDNS1123(in))
+	}
+	assert.NotEqual(t, toDNS1123("!!!"), toDNS1123("???"))
+}
+
+func TestRequireDistinctNodes(t *testing.T) {
+	tpl := `{{ requireDistinctNodes "app.kubernetes.io/name" "web" .Values.replicas | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{
+		"Values": map[string]interface{}{"replicas": float64(3)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `podAntiAffinity:
+  requiredDuringSchedulingIgnoredDuringExecution:
+  - labelSelector:
+      matchLabels:
+        app.kubernetes.io/name: web
+    topologyKey: kubernetes.io/hostname`, b.String())
+
+	affinity, err := requireDistinctNodes("app", "web", 1)
+	assert.NoError(t, err)
+	assert.Empty(t, affinity)
+
+	for _, n := range []interface{}{0, -1, 2.5, "3"} {
+		_, err = requireDistinctNodes("app", "web", n)
+		assert.Error(t, err, "%v", n)
+	}
+	_, err = requireDistinctNodes("not a key!", "web", 2)
+	assert.Error(t, err)
+	_, err = requireDistinctNodes("app", "not a value!", 2)
+	assert.Error(t, err)
+}
+
+func TestRequireNodeCapacity(t *testing.T) {
+	tpl := `replicas: {{ requireNodeCapacity .replicas .nodes }}{{ .replicas }}`
+	for _, tt := range []struct {
+		replicas, nodes interface{}
+		err             string
+	}{
+		{replicas: 3, nodes: 3},
+		{replicas: float64(2), nodes: float64(5)},
+		{replicas: float64(4), nodes: 3, err: "4 replicas require distinct nodes, but only 3 nodes are available"},
+		{replicas: "many", nodes: 3, err: "invalid replica count many"},
+	} {
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{
+			"replicas": tt.replicas,
+			"nodes":    tt.nodes,
+		})
+		if tt.err == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("replicas: %v", tt.replicas), b.String())
+			continue
+		}
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), tt.err)
+		}
+	}
+}
+
+func TestCPUAndMemoryConversion(t *testing.T) {
+	for in, expect := range map[string]int64{
+		"500m":  500000000,
+		"2":     2000000000,
+		"0.25":  250000000,
+		"1.5":   1500000000,
+		"100n":  100,
+		"1500u": 1500000,
+	} {
+		n, err := cpuToNanos(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, n, in)
+	}
+
+	for in, expect := range map[int64]string{
+		500000000:  "500m",
+		2000000000: "2",
+		1500000000: "1500m",
+		1:          "1n",
+	} {
+		cpu, err := nanosToCPU(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, cpu)
+	}
+
+	for in, expect := range map[string]int64{
+		"512Mi": 536870912,
+		"1G":    1000000000,
+		"1.5Ki": 1536,
+		"0.5":   1,
+	} {
+		n, err := memoryToBytes(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, n, in)
+	}
+
+	for in, expect := range map[int64]string{
+		536870912: "512Mi",
+		1536:      "1536",
+		1000:      "1k",
+	} {
+		memory, err := bytesToMemory(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, memory)
+	}
+
+	_, err := cpuToNanos("half")
+	assert.Error(t, err)
+	_, err = memoryToBytes("1 GB")
+	assert.Error(t, err)
+	_, err = nanosToCPU(1.5)
+	assert.Error(t, err)
+	_, err = bytesToMemory("1Gi")
+	assert.Error(t, err)
+
+	// Numbers from values files are float64.
+	var b strings.Builder
+	tpl := `{{ nanosToCpu .Values.nanos }} {{ bytesToMemory .Values.bytes }}`
+	vals := map[string]interface{}{"Values": map[string]interface{}{"nanos": float64(500000000), "bytes": float64(536870912)}}
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, vals)
+	assert.NoError(t, err)
+	assert.Equal(t, "500m 512Mi", b.String())
+}
+
+func TestToYAMLAndToJSONSortKeys(t *testing.T) {
+	// Build the maps inside the template so that the test covers values
+	// produced by chart authors, not just those loaded from values files.
+	tpl := `{{- $inner := dict "zulu" 1 "alpha" 2 "mike" (dict "y" true "b" false) -}}
+{{- $outer := dict "b" $inner "a" (list (dict "d" 1 "c" 2)) "c" "x" -}}
+{{ toYaml $outer }}
+{{ toJson $outer }}`
+
+	expect := `a:
+- c: 2
+  d: 1
+b:
+  alpha: 2
+  mike:
+    b: false
+    "y": true
+  zulu: 1
+c: x
+{"a":[{"c":2,"d":1}],"b":{"alpha":2,"mike":{"b":false,"y":true},"zulu":1},"c":"x"}`
+
+	// Go randomizes map iteration, so render several times.
+	for i := 0; i < 20; i++ {
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, b.String())
+	}
+}
+
+func BenchmarkB64Enc(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024/16)
+	b64enc := funcMap()["b64enc"].(func(string) string)
+
+	b.Run("b64enc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			// Mirrors {{ .Files.GetBytes "f" | toString | b64enc }}.
+			_ = b64enc(string(data))
+		}
+	})
+	b.Run("b64encBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = b64encBytes(data)
+		}
+	})
+}
+
+func TestFingerprint(t *testing.T) {
+	desired := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+  labels:
+    app: web
+data:
+  key: value
+`
+	live := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+  labels:
+    app: web
+  creationTimestamp: "2022-01-01T00:00:00Z"
+  resourceVersion: "12345"
+  uid: 0c9c5b58-5d1b-4b6b-a1b0-5d1c1d2a1e33
+  generation: 3
+status:
+  phase: Active
+data:
+  key: value
+`
+	changed := strings.Replace(desired, "key: value", "key: other", 1)
+
+	desiredObj := fromYAML(desired)
+	liveObj := fromYAML(live)
+
+	assert.Equal(t, fingerprint(desiredObj), fingerprint(liveObj))
+	assert.NotEqual(t, fingerprint(desiredObj), fingerprint(fromYAML(changed)))
+	assert.Len(t, fingerprint(desiredObj), 64)
+
+	// The input must not be modified.
+	assert.Contains(t, liveObj, "status")
+	assert.Contains(t, liveObj["metadata"], "uid")
+
+	tpl := `{{ eq (fingerprint (fromYaml .desired)) (fingerprint (fromYaml .live)) }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"desired": desired, "live": live})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", b.String())
+}
+
+func TestMustFromJSON(t *testing.T) {
+	a, err := mustFromJSONArray(`["one", 2, {"name": "helm"}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, fromJSONArray(`["one", 2, {"name": "helm"}]`), a)
+
+	// mustFromJson is sprig's, which parses any JSON document.
+	for _, tt := range []struct{ tpl, vars, expect string }{
+		{`{{ mustFromJson . }}`, `{"hello": "world", "list": [1, 2]}`, `map[hello:world list:[1 2]]`},
+		{`{{ mustFromJson . }}`, `["one", "two"]`, `[one two]`},
+		{`{{ mustFromJson . }}`, `"plain"`, `plain`},
+	} {
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tt.tpl)).Execute(&b, tt.vars)
+		assert.NoError(t, err, tt.vars)
+		assert.Equal(t, tt.expect, b.String())
+	}
+
+	for _, tt := range []struct{ tpl, vars string }{
+		{`{{ mustFromJson . }}`, `{"hello":`},
+		{`{{ mustFromJsonArray . }}`, `{"hello": "world"}`},
+		{`{{ mustFromJsonArray . }}`, `["one",`},
+	} {
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tt.tpl)).Execute(&b, tt.vars)
+		assert.Error(t, err, tt.vars)
+	}
+}
+
+func TestCloneValues(t *testing.T) {
+	original := fromYAML(`
+image:
+  repository: nginx
+  tag: "1.23"
+ports:
+- name: http
+  port: 80
+annotations: ~
+`)
+	clone := cloneValues(original).(map[string]interface{})
+	assert.Equal(t, original, clone)
+
+	clone["image"].(map[string]interface{})["tag"] = "1.25"
+	clone["ports"].([]interface{})[0].(map[string]interface{})["port"] = 8080
+	clone["replicas"] = 3
+	assert.Equal(t, "1.23", original["image"].(map[string]interface{})["tag"])
+	assert.Equal(t, float64(80), original["ports"].([]interface{})[0].(map[string]interface{})["port"])
+	assert.NotContains(t, original, "replicas")
+
+	nonStringKeys := map[interface{}]interface{}{1: []interface{}{"one"}, true: "yes"}
+	cloned := cloneValues(nonStringKeys).(map[interface{}]interface{})
+	cloned[1].([]interface{})[0] = "uno"
+	assert.Equal(t, "one", nonStringKeys[1].([]interface{})[0])
+
+	values := chartutil.Values{"nested": map[string]interface{}{"key": "value"}}
+	assert.IsType(t, chartutil.Values{}, cloneValues(values))
+	ch := make(chan int)
+	assert.Equal(t, ch, cloneValues(ch))
+
+	tpl := `{{ $v := cloneValues .Values.image }}{{ $_ := set $v "tag" "latest" }}{{ $v.tag }} {{ .Values.image.tag }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"Values": original})
+	assert.NoError(t, err)
+	assert.Equal(t, "latest 1.23", b.String())
+}
+
+func TestWebhookClientConfig(t *testing.T) {
+	tpl := `{{ webhookClientConfig "my-webhook" "system" "/validate" "Y2VydA==" | toYaml }}
+---
+{{ webhookClientConfig "" "" "https://webhook.example.com/validate" "" | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `caBundle: Y2VydA==
+service:
+  name: my-webhook
+  namespace: system
+  path: /validate
+---
+url: https://webhook.example.com/validate`, b.String())
+
+	// The CA bundle is left to an injector.
+	assert.Equal(t, map[string]interface{}{
+		"service": map[string]interface{}{"name": "my-webhook", "namespace": "system"},
+	}, webhookClientConfig("my-webhook", "system", "", ""))
+}
+
+func TestURLEscape(t *testing.T) {
+	for _, tt := range []struct {
+		in, path, query string
+	}{
+		{"hello world", "hello%20world", "hello+world"},
+		{"a+b", "a+b", "a%2Bb"},
+		{"a/b?c", "a%2Fb%3Fc", "a%2Fb%3Fc"},
+		{"k=v&x=y", "k=v&x=y", "k%3Dv%26x%3Dy"},
+		{"caf\u00e9", "caf%C3%A9", "caf%C3%A9"},
+	} {
+		tpl := `{{ urlPathEscape .in }} {{ urlQueryEscape .in }} {{ .path | urlPathUnescape }} {{ .query | urlQueryUnescape }}`
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"in": tt.in, "path": tt.path, "query": tt.query})
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Join([]string{tt.path, tt.query, tt.in, tt.in}, " "), b.String())
+	}
+
+	// '+' only means a space in a query.
+	assert.Equal(t, "a+b", urlPathUnescape("a+b"))
+	assert.Equal(t, "a b", urlQueryUnescape("a+b"))
+
+	// Invalid escapes are returned unchanged.
+	assert.Equal(t, "100%", urlPathUnescape("100%"))
+	assert.Equal(t, "%zz", urlQueryUnescape("%zz"))
+}
+
+func TestRolloutControl(t *testing.T) {
+	tpl := `{{ rolloutControl true | toJson }} {{ rolloutControl false | toJson }} {{ rolloutControl true "example.com/paused" | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"paused":true} {"paused":false} {"annotations":{"example.com/paused":"true"}}`, b.String())
+
+	_, err = rolloutControl(true, "")
+	assert.Error(t, err)
+	_, err = rolloutControl(true, "a", "b")
+	assert.Error(t, err)
+}
+
+func TestDurationSeconds(t *testing.T) {
+	for in, expect := range map[interface{}]int64{
+		"90s":    90,
+		"1h30m":  5400,
+		"2m":     120,
+		"1500ms": 2,
+		"200ms":  1,
+		"0s":     0,
+		30:       30,
+		15.0:     15,
+	} {
+		got, err := durationSeconds(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, got, in)
+	}
+
+	for _, in := range []interface{}{"", "30", "ten seconds", "-5s", 1.5, -1, true} {
+		_, err := durationSeconds(in)
+		assert.Error(t, err, in)
+	}
+
+	tpl := `periodSeconds: {{ durationSeconds .period }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"period": "1m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "periodSeconds: 60", b.String())
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := `{
+  "type": "object",
+  "required": ["name", "port"],
+  "properties": {
+    "name": {"type": "string"},
+    "port": {"type": "integer"}
+  }
+}`
+	valid := map[string]interface{}{"name": "web", "port": 8080}
+	out, err := jsonSchemaValidate(schema, valid)
+	assert.NoError(t, err)
+	assert.Equal(t, valid, out)
+
+	_, err = jsonSchemaValidate(fromJSON(schema), `{"name": "web", "port": 8080}`)
+	assert.NoError(t, err)
+
+	_, err = jsonSchemaValidate(schema, map[string]interface{}{"name": "web", "port": "http"})
+	assert.EqualError(t, err, "document does not match the schema:\n- port: Invalid type. Expected: integer, given: string")
+
+	_, err = jsonSchemaValidate(schema, chartutil.Values{"port": 80, "name": true})
+	assert.EqualError(t, err, "document does not match the schema:\n- name: Invalid type. Expected: string, given: boolean")
+
+	_, err = jsonSchemaValidate(schema, map[string]interface{}{"port": 8080})
+	assert.EqualError(t, err, "document does not match the schema:\n- (root): name is required")
+
+	_, err = jsonSchemaValidate(`{"type": `, valid)
+	assert.Error(t, err)
+
+	tpl := `{{ .config | jsonSchemaValidate .schema | toJson }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"schema": schema, "config": map[string]interface{}{"name": 42}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "port is required")
+	assert.Contains(t, err.Error(), "name: Invalid type")
+}
+
+func TestRequireTogether(t *testing.T) {
+	keys := []string{"tls.cert", "tls.key", "tls.ca"}
+
+	_, err := requireTogether(map[string]interface{}{
+		"tls": map[string]interface{}{"cert": "CERT", "key": "KEY", "ca": "CA"},
+	}, keys...)
+	assert.NoError(t, err)
+
+	_, err = requireTogether(map[string]interface{}{}, keys...)
+	assert.NoError(t, err)
+	_, err = requireTogether(map[string]interface{}{
+		"tls": map[string]interface{}{"cert": "", "key": nil},
+	}, keys...)
+	assert.NoError(t, err)
+
+	_, err = requireTogether(map[string]interface{}{
+		"tls": map[string]interface{}{"cert": "CERT", "key": ""},
+	}, keys...)
+	assert.EqualError(t, err, "tls.cert, tls.key, tls.ca must be set together: tls.cert set but tls.key, tls.ca not")
+
+	tpl := `{{ requireTogether .Values "tls.cert" "tls.key" }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{
+		"Values": chartutil.Values{"tls": map[string]interface{}{"key": "KEY"}},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tls.key set but tls.cert not")
+}
+
+func TestToYAMLArray(t *testing.T) {
+	for _, tt := range []struct {
+		in     interface{}
+		expect string
+	}{
+		{"nginx", "- nginx"},
+		{8080, "- 8080"},
+		{map[string]interface{}{"name": "http", "port": 80}, "- name: http\n  port: 80"},
+		{[]interface{}{"a", map[string]interface{}{"b": 1}}, "- a\n- b: 1"},
+		{[]string{"a", "b"}, "- a\n- b"},
+		{[]interface{}{}, "[]"},
+		{nil, "[]"},
+	} {
+		assert.Equal(t, tt.expect, toYAMLArray(tt.in), "%v", tt.in)
+	}
+
+	tpl := `{{ toYamlArray .Values.tolerations }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{
+		"Values": map[string]interface{}{"tolerations": map[string]interface{}{"key": "gpu", "operator": "Exists"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "- key: gpu\n  operator: Exists", b.String())
+}
+
+func TestCoalesceEmpty(t *testing.T) {
+	assert.Equal(t, "nginx", coalesceEmpty("  ", "\t\n", "nginx", "httpd"))
+	assert.Equal(t, " x ", coalesceEmpty("", " x ", "y"))
+	assert.Equal(t, 8080, coalesceEmpty(nil, 0, 8080))
+	assert.Equal(t, true, coalesceEmpty(false, map[string]interface{}{}, []interface{}{}, true))
+	assert.Nil(t, coalesceEmpty("  ", 0, nil))
+	assert.Nil(t, coalesceEmpty())
+
+	tpl := `{{ coalesceEmpty .Values.tag .Chart.AppVersion }} {{ coalesce .Values.tag .Chart.AppVersion | quote }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{
+		"Values": map[string]interface{}{"tag": "   "},
+		"Chart":  map[string]interface{}{"AppVersion": "1.2.3"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `1.2.3 "   "`, b.String())
+}
+
+func TestKustomization(t *testing.T) {
+	tpl := `{{ kustomization (list "service.yaml" "deployment.yaml" "configmap.yaml") "apps" (dict "app" "web" "tier" "frontend") }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+commonLabels:
+  app: web
+  tier: frontend
+kind: Kustomization
+namespace: apps
+resources:
+- configmap.yaml
+- deployment.yaml
+- service.yaml`, b.String())
+
+	k := fromYAML(kustomization([]interface{}{"b.yaml", "a.yaml"}, "", nil))
+	assert.Equal(t, map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  []interface{}{"a.yaml", "b.yaml"},
+	}, k)
+}
+
+func TestReplaceLiteral(t *testing.T) {
+	for _, replacement := range []string{"pa$1word", "${name}", "$$", `\1`} {
+		tpl := `{{ .input | replaceLiteral "@PASSWORD@" .replacement }}`
+		var b strings.Builder
+		err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{
+			"input":       "password=@PASSWORD@ confirm=@PASSWORD@",
+			"replacement": replacement,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "password="+replacement+" confirm="+replacement, b.String())
+	}
+	assert.Equal(t, "unchanged", replaceLiteral("missing", "$1", "unchanged"))
+}
+
+func TestQuantityArithmetic(t *testing.T) {
+	for _, tt := range []struct {
+		quantity string
+		factor   interface{}
+		expect   string
+	}{
+		{"512Mi", 0.75, "384Mi"},
+		{"1Gi", 0.5, "512Mi"},
+		{"2", 3, "6"},
+		{"500m", "1.5", "750m"},
+		{"1G", 0.25, "250M"},
+	} {
+		got, err := quantityMul(tt.quantity, tt.factor)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, got, "%s * %v", tt.quantity, tt.factor)
+	}
+
+	for _, tt := range []struct{ a, b, expect string }{
+		{"1Gi", "512Mi", "1536Mi"},
+		{"250m", "750m", "1"},
+		{"1G", "500M", "1500M"},
+	} {
+		got, err := quantityAdd(tt.a, tt.b)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, got, "%s + %s", tt.a, tt.b)
+	}
+
+	_, err := quantityMul("lots", 2)
+	assert.Error(t, err)
+	_, err = quantityMul("512Mi", "three quarters")
+	assert.Error(t, err)
+	_, err = quantityAdd("1Gi", "more")
+	assert.Error(t, err)
+
+	tpl := `-Xmx{{ quantityMul .limit 0.75 | memoryToBytes }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"limit": "2Gi"})
+	assert.NoError(t, err)
+	assert.Equal(t, "-Xmx1610612736", b.String())
+}
+
+func TestResourceOrDefault(t *testing.T) {
+	for _, tt := range []struct {
+		value, def interface{}
+		expect     string
+	}{
+		{nil, "100m", "100m"},
+		{"", "128Mi", "128Mi"},
+		{"  ", "0.5", "500m"},
+		{"250m", "100m", "250m"},
+		{"0.5", "100m", "500m"},
+		{float64(2), "100m", "2"},
+		{"1024Mi", "128Mi", "1Gi"},
+		{nil, 1, "1"},
+	} {
+		got, err := resourceOrDefault(tt.value, tt.def)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, got, "%v %v", tt.value, tt.def)
+	}
+
+	_, err := resourceOrDefault("lots", "100m")
+	assert.Error(t, err)
+	_, err = resourceOrDefault("250m", "some")
+	assert.Error(t, err)
+
+	tpl := `{{ resourceOrDefault .requests.cpu "100m" }} {{ resourceOrDefault .requests.memory "128Mi" }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"requests": map[string]interface{}{"memory": "256Mi"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "100m 256Mi", b.String())
+}
+
+func TestReindent(t *testing.T) {
+	tests := []struct {
+		name   string
+		spaces int
+		block  string
+		expect string
+	}{
+		{
+			name:   "inconsistent spaces",
+			spaces: 2,
+			block:  "server:\n    port: 8080\n    hosts:\n        - a.example.com\n        - b.example.com\t\nlogging:\n level:\tinfo   # verbose in dev\n",
+			expect: "  server:\n    port: 8080\n    hosts:\n      - a.example.com\n      - b.example.com\n  logging:\n    level: info # verbose in dev",
+		},
+		{
+			name:   "multiple documents",
+			block:  "a:\n     b: 1\n---\nlist:\n-   x\n-   y: z\n",
+			expect: "a:\n  b: 1\n---\nlist:\n  - x\n  - y: z",
+		},
+		{
+			name:   "indented multiple documents",
+			spaces: 4,
+			block:  "a:\n     b: 1\n---\nlist:\n-   x\n",
+			expect: "    a:\n      b: 1\n---\n    list:\n      - x",
+		},
+		{
+			name:   "tabs",
+			spaces: 2,
+			block:  "server:\n\tport: 8080\n",
+			expect: "  server:\n    port: 8080",
+		},
+		{
+			// A tab advances to the next tab stop, so the first three keys
+			// under server are at the same level, eight columns in.
+			name:   "mixed tabs and spaces",
+			block:  "server:\n\tport: 8080\n        host: example.com\n  \ttls:\n\t    enabled: true\n    \t    ciphers: [a, b]\n",
+			expect: "server:\n  port: 8080\n  host: example.com\n  tls:\n    enabled: true\n    ciphers: [a, b]",
+		},
+		{
+			// Tabs in a valid block, such as in a literal scalar, are kept.
+			name:   "tabs in a scalar",
+			block:  "script: |\n    make:\n    \tgo build\n",
+			expect: "script: |\n  make:\n  \tgo build",
+		},
+		{
+			name:   "invalid",
+			spaces: 2,
+			block:  "a: [1, 2\n",
+			expect: "a: [1, 2\n",
+		},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, reindent(tt.spaces, tt.block), tt.name)
+	}
+
+	// The indented documents are still separate documents.
+	dec := yamlv3.NewDecoder(strings.NewReader(reindent(4, "a: 1\n---\nb: 2\n")))
+	var docs []map[string]int
+	for {
+		var doc map[string]int
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	assert.Equal(t, []map[string]int{{"a": 1}, {"b": 2}}, docs)
+
+	tpl := `data:
+{{ .block | reindent 2 }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"block": "key:\n      value: 1\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, "data:\n  key:\n    value: 1", b.String())
+}
+
+func TestMustToJSON(t *testing.T) {
+	// mustToJson is sprig's. It matches toJson where that succeeds, and fails
+	// the render where toJson would emit an empty string.
+	tpl := template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ mustToJson .value }}`))
+	for _, v := range []interface{}{
+		map[string]interface{}{"b": []interface{}{1, "two"}, "a": nil},
+		[]string{"x"},
+		"plain",
+		nil,
+	} {
+		var b strings.Builder
+		err := tpl.Execute(&b, map[string]interface{}{"value": v})
+		assert.NoError(t, err)
+		assert.Equal(t, toJSON(v), b.String())
+	}
+
+	unmarshalable := map[string]interface{}{"callback": func() {}}
+	assert.Equal(t, "", toJSON(unmarshalable))
+	var b strings.Builder
+	err := tpl.Execute(&b, map[string]interface{}{"value": unmarshalable})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported type: func()")
+}
+
+func TestToConfigMapData(t *testing.T) {
+	data := map[string]interface{}{
+		"nginx.conf": "server {\n  listen 80;\n}\n",
+		"LOG_LEVEL":  "info",
+		"banner.txt": "line one  \nline two\n",
+		"script.sh":  "#!/bin/sh\necho done",
+		"PORT":       8080,
+		"EMPTY":      nil,
+	}
+	assert.Equal(t, `EMPTY: ""
+LOG_LEVEL: "info"
+PORT: "8080"
+banner.txt: "line one  \nline two\n"
+nginx.conf: |
+  server {
+    listen 80;
+  }
+script.sh: |-
+  #!/bin/sh
+  echo done`, toConfigMapData(data))
+
+	// The rendered data decodes to the same strings.
+	decoded := fromYAML(toConfigMapData(data))
+	for _, k := range []string{"nginx.conf", "banner.txt", "script.sh"} {
+		assert.Equal(t, data[k], decoded[k], k)
+	}
+
+	assert.Equal(t, "{}", toConfigMapData(map[string]interface{}{}))
+}
+
+func TestB64DecBytes(t *testing.T) {
+	binary := []byte{0xfb, 0xff, 0xbf, 0x00, 'h', 'i'}
+	for _, in := range []string{
+		"+/+/AGhp",   // standard
+		"-_-_AGhp",   // URL-safe
+		"+/+/AGhp\n", // trailing newline
+	} {
+		out, err := b64decBytes(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, binary, out, in)
+	}
+
+	for in, expect := range map[string]string{
+		"aGVsbG8=":            "hello",
+		"aGVsbG8":             "hello",
+		"aGVs\nbG8gd29y\nbGQ": "hello world",
+	} {
+		out, err := b64decBytes(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expect, string(out), in)
+	}
+
+	for _, in := range []string{"aGVs*G8=", "a", "héllo"} {
+		_, err := b64decBytes(in)
+		assert.Error(t, err, in)
+	}
+
+	tpl := `{{ b64decBytes .data | b64encBytes }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"data": "-_-_AGhp"})
+	assert.NoError(t, err)
+	assert.Equal(t, "+/+/AGhp", b.String())
+
+	// Printed as is, the bytes are a list of numbers, so text goes through
+	// toString.
+	for tpl, expect := range map[string]string{
+		`{{ b64decBytes .data }}`:                    "[104 105]",
+		`{{ b64decBytes .data | toString | quote }}`: `"hi"`,
+	} {
+		b.Reset()
+		err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"data": "aGk"})
+		assert.NoError(t, err)
+		assert.Equal(t, expect, b.String(), tpl)
+	}
+}
+
+func TestRFC3339(t *testing.T) {
+	// The output must not depend on the local time zone.
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+9", 9*60*60)
+
+	ts := time.Date(2022, 6, 1, 21, 30, 0, 0, time.Local)
+	assert.Equal(t, "2022-06-01T12:30:00Z", toRFC3339(ts))
+	assert.Equal(t, "2022-06-01T12:30:00Z", toRFC3339(&ts))
+	assert.Equal(t, "2022-06-01T12:30:00Z", toRFC3339(ts.Unix()))
+	assert.Equal(t, "", toRFC3339("yesterday"))
+
+	parsed := parseRFC3339("2022-06-01T14:30:00+02:00")
+	assert.Equal(t, time.UTC, parsed.Location())
+	assert.True(t, parsed.Equal(ts))
+	assert.Equal(t, "2022-06-01T12:30:00Z", toRFC3339(parsed))
+	assert.True(t, parseRFC3339("2022-06-01").IsZero())
+
+	tpl := `{{ parseRFC3339 .ts | toRFC3339 }} {{ (parseRFC3339 "not a time").IsZero }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"ts": "2022-06-01T12:30:00.5-07:00"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2022-06-01T19:30:00Z true", b.String())
+}
+
+func TestTimestampLabel(t *testing.T) {
+	ts := time.Date(2022, 6, 1, 21, 30, 5, 0, time.FixedZone("UTC+9", 9*60*60))
+	got := timestampLabel(ts)
+	assert.Equal(t, "2022-06-01t12-30-05z", got)
+	assert.Empty(t, validation.IsValidLabelValue(got))
+	assert.Equal(t, got, timestampLabel(ts.Unix()))
+	assert.Equal(t, "", timestampLabel("yesterday"))
+
+	// Later times sort after earlier ones.
+	times := []time.Time{
+		time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC),
+		time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 1; i < len(times); i++ {
+		assert.Less(t, timestampLabel(times[i-1]), timestampLabel(times[i]))
+	}
+
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ timestampLabel . }}`)).Execute(&b, ts)
+	assert.NoError(t, err)
+	assert.Equal(t, "2022-06-01t12-30-05z", b.String())
+}
+
+func TestFilterIn(t *testing.T) {
+	services := []interface{}{
+		map[string]interface{}{"name": "web", "tier": "frontend", "port": float64(80)},
+		map[string]interface{}{"name": "api", "tier": "backend", "port": float64(8080)},
+		map[string]interface{}{"name": "db", "tier": "data", "port": float64(5432)},
+		map[string]interface{}{"name": "cron"},
+		"not a map",
+	}
+	out, err := filterIn("tier", []interface{}{"backend", "frontend"}, services)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{services[0], services[1]}, out)
+
+	// Numbers from values files match integers from templates.
+	out, err = filterIn("port", []interface{}{5432}, services)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{services[2]}, out)
+
+	out, err = filterIn("tier", []interface{}{}, services)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	type node struct {
+		Name string
+		Zone string
+	}
+	nodes := []*node{{"a", "us-east-1a"}, {"b", "us-east-1b"}, {"c", "us-east-1c"}}
+	out, err = filterIn("Zone", []interface{}{"us-east-1a", "us-east-1c"}, nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nodes[0], nodes[2]}, out)
+
+	_, err = filterIn("tier", []interface{}{"frontend"}, "not a list")
+	assert.Error(t, err)
+
+	tpl := `{{ range filterIn "tier" (list "frontend" "backend") .services }}{{ .name }} {{ end }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"services": services})
+	assert.NoError(t, err)
+	assert.Equal(t, "web api ", b.String())
+}
+
+func TestFilterOp(t *testing.T) {
+	deployments := []interface{}{
+		map[string]interface{}{"name": "web", "replicas": float64(5), "enabled": true},
+		map[string]interface{}{"name": "api", "replicas": float64(3), "enabled": false},
+		map[string]interface{}{"name": "db", "replicas": float64(1), "enabled": true},
+		map[string]interface{}{"name": "cron"},
+	}
+	for _, tt := range []struct {
+		key, op string
+		value   interface{}
+		expect  []interface{}
+	}{
+		{"replicas", ">", 3, []interface{}{deployments[0]}},
+		{"replicas", ">=", 3, []interface{}{deployments[0], deployments[1]}},
+		{"replicas", "<", 3.5, []interface{}{deployments[1], deployments[2]}},
+		{"replicas", "<=", int64(1), []interface{}{deployments[2]}},
+		{"replicas", "==", 3, []interface{}{deployments[1]}},
+		{"replicas", "!=", 3, []interface{}{deployments[0], deployments[2]}},
+		{"name", "<", "cron", []interface{}{deployments[1]}},
+		{"name", ">=", "db", []interface{}{deployments[0], deployments[2]}},
+		{"enabled", "==", true, []interface{}{deployments[0], deployments[2]}},
+		{"replicas", ">", 10, []interface{}{}},
+	} {
+		out, err := filterOp(tt.key, tt.op, tt.value, deployments)
+		assert.NoError(t, err, "%s %s %v", tt.key, tt.op, tt.value)
+		assert.Equal(t, tt.expect, out, "%s %s %v", tt.key, tt.op, tt.value)
+	}
+
+	type node struct {
+		Name string
+		CPUs int
+	}
+	nodes := []node{{"a", 2}, {"b", 8}, {"c", 16}}
+	out, err := filterOp("CPUs", ">", 4, nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nodes[1], nodes[2]}, out)
+
+	_, err = filterOp("replicas", ">", "3", deployments)
+	assert.EqualError(t, err, `filterOp: cannot compare field "replicas": 5 (float64) and 3 (string) are not both numbers`)
+	_, err = filterOp("enabled", "<", true, deployments)
+	assert.Error(t, err)
+	_, err = filterOp("replicas", "=~", 3, deployments)
+	assert.EqualError(t, err, `filterOp: unknown operator "=~"`)
+	_, err = filterOp("replicas", ">", 3, "not a list")
+	assert.Error(t, err)
+
+	tpl := `{{ range filterOp "replicas" ">" 2 .deployments }}{{ .name }} {{ end }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"deployments": deployments})
+	assert.NoError(t, err)
+	assert.Equal(t, "web api ", b.String())
+}
+
+func TestMergeMapsStrict(t *testing.T) {
+	a := map[string]interface{}{
+		"prometheus.io/scrape": "true",
+		"nested":               map[string]interface{}{"a": "1"},
+	}
+	b := map[string]interface{}{
+		"prometheus.io/port": float64(9090),
+		"nested":             map[string]interface{}{"b": "2"},
+	}
+	merged, err := mergeMapsStrict(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"prometheus.io/scrape": "true",
+		"prometheus.io/port":   float64(9090),
+		"nested":               map[string]interface{}{"a": "1", "b": "2"},
+	}, merged)
+	assert.Equal(t, map[string]interface{}{"a": "1"}, a["nested"], "expected the inputs to be left alone")
+
+	// Setting a key to the same value again is fine.
+	merged, err = mergeMapsStrict(a, map[string]interface{}{"prometheus.io/scrape": "true", "nested": map[string]interface{}{"a": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, a, merged)
+	_, err = mergeMapsStrict(b, map[string]interface{}{"prometheus.io/port": 9090})
+	assert.NoError(t, err)
+
+	_, err = mergeMapsStrict(a, map[string]interface{}{"prometheus.io/scrape": "false"})
+	assert.EqualError(t, err, `conflicting values for "prometheus.io/scrape": true and false`)
+	_, err = mergeMapsStrict(a, map[string]interface{}{"nested": map[string]interface{}{"a": "2"}})
+	assert.EqualError(t, err, `conflicting values for "nested.a": 1 and 2`)
+	_, err = mergeMapsStrict(a, map[string]interface{}{"nested": "flat"})
+	assert.Error(t, err)
+
+	merged, err = mergeMapsStrict()
+	assert.NoError(t, err)
+	assert.Empty(t, merged)
+
+	tpl := `{{ mergeMapsStrict .a .b | toJson }}`
+	var out strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&out, chartutil.Values{"a": chartutil.Values{"x": 1}, "b": map[string]interface{}{"x": 2}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `conflicting values for "x"`)
+}
+
+func TestFromJSONNumbers(t *testing.T) {
+	m := fromJSONNumbers(`{"id": 6443000000000, "max": 9223372036854775807, "ratio": 0.1000000000000000055511151231257827}`)
+	assert.NotContains(t, m, "Error")
+	assert.Equal(t, json.Number("9223372036854775807"), m["max"])
+
+	assert.Equal(t, `{"id":6443000000000,"max":9223372036854775807,"ratio":0.1000000000000000055511151231257827}`, toJSON(m))
+	assert.Equal(t, "9223372036854775807", toYAML(m["max"]))
+	assert.Equal(t, "6443000000000", toYAML(m["id"]))
+
+	// fromJson loses the precision of both.
+	assert.Equal(t, `{"max":9223372036854776000,"ratio":0.1}`, toJSON(fromJSON(`{"max": 9223372036854775807, "ratio": 0.1000000000000000055511151231257827}`)))
+
+	assert.Contains(t, fromJSONNumbers(`{"id": }`)["Error"], "invalid character")
+	assert.Equal(t, "invalid data after the JSON document", fromJSONNumbers(`{"id": 1} {"id": 2}`)["Error"])
+
+	tpl := `{{ (fromJsonNumbers .json).id }} {{ fromJsonNumbers .json | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"json": `{"id": 6443000000000}`})
+	assert.NoError(t, err)
+	assert.Equal(t, `6443000000000 {"id":6443000000000}`, b.String())
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	base := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "web", "labels": map[string]interface{}{"tier": "frontend"}},
+		"spec":     map[string]interface{}{"replicas": float64(1), "paused": true},
+	}
+	patched := applyJSONPatch(`[
+		{"op": "add", "path": "/metadata/labels/team", "value": "platform"},
+		{"op": "remove", "path": "/spec/paused"},
+		{"op": "replace", "path": "/spec/replicas", "value": 3}
+	]`, base)
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "web", "labels": map[string]interface{}{"tier": "frontend", "team": "platform"}},
+		"spec":     map[string]interface{}{"replicas": float64(3)},
+	}, patched)
+	assert.Equal(t, true, base["spec"].(map[string]interface{})["paused"], "expected the document to be left alone")
+
+	// The patch can be a list of operations built in the template.
+	patched = applyJSONPatch([]interface{}{
+		map[string]interface{}{"op": "replace", "path": "/metadata/name", "value": "api"},
+	}, base)
+	assert.Equal(t, "api", patched["metadata"].(map[string]interface{})["name"])
+
+	assert.Contains(t, applyJSONPatch(`[{"op": "replace", "path": "/status/replicas", "value": 1}]`, base)["Error"], "doc is missing path: /status/replicas")
+	assert.Contains(t, applyJSONPatch(`[{"op": "remove", "path": "/status"}]`, base)["Error"], "Unable to remove nonexistent key")
+	assert.Contains(t, applyJSONPatch(`{"op": "add"}`, base), "Error")
+
+	tpl := `{{ $patch := list (dict "op" "add" "path" "/spec/replicas" "value" 5) }}{{ applyJsonPatch $patch .base | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"base": map[string]interface{}{"spec": map[string]interface{}{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"spec":{"replicas":5}}`, b.String())
+}
+
+func TestStrategicMergePatch(t *testing.T) {
+	base := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": float64(1),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "app", "image": "app:1", "args": []interface{}{"--verbose"}},
+						map[string]interface{}{"name": "sidecar", "image": "envoy:1"},
+					},
+				},
+			},
+		},
+	}
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": float64(3),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "sidecar", "image": "envoy:2"},
+						map[string]interface{}{"name": "debug", "image": "busybox"},
+					},
+				},
+			},
+		},
+	}
+
+	patched := strategicMergePatch(base, patch, "apps/v1/Deployment")
+	assert.NotContains(t, patched, "Error")
+	spec := patched["spec"].(map[string]interface{})
+	assert.Equal(t, float64(3), spec["replicas"])
+	// Containers are merged by name: app is kept, sidecar is updated and
+	// debug is added.
+	assert.ElementsMatch(t, []interface{}{
+		map[string]interface{}{"name": "app", "image": "app:1", "args": []interface{}{"--verbose"}},
+		map[string]interface{}{"name": "sidecar", "image": "envoy:2"},
+		map[string]interface{}{"name": "debug", "image": "busybox"},
+	}, spec["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"])
+	assert.Equal(t, "envoy:1", base["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[1].(map[string]interface{})["image"], "expected base to be left alone")
+
+	// A directive removes a container by its merge key.
+	patched = strategicMergePatch(base, map[string]interface{}{
+		"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"name": "sidecar", "$patch": "delete"}},
+		}}},
+	}, "apps/v1/Deployment")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "app", "image": "app:1", "args": []interface{}{"--verbose"}},
+	}, patched["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"])
+
+	// Only built-in kinds have the merge keys.
+	assert.Contains(t, strategicMergePatch(base, patch, "example.com/v1/Widget")["Error"], "no kind \"Widget\" is registered")
+	assert.Contains(t, strategicMergePatch(base, patch, "Deployment")["Error"], "invalid kind")
+
+	tpl := `{{ (strategicMergePatch .base .patch "apps/v1/Deployment").spec.replicas }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"base": base, "patch": patch})
+	assert.NoError(t, err)
+	assert.Equal(t, "3", b.String())
+}
+
+func TestDiffMaps(t *testing.T) {
+	desired := map[string]interface{}{
+		"replicas": float64(1),
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.23"},
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1", "memory": "1Gi"},
+		},
+		"debug": true,
+		"ports": []interface{}{float64(80)},
+	}
+	current := map[string]interface{}{
+		"replicas": float64(3),
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.25", "pullPolicy": "Always"},
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1", "memory": "1Gi"},
+		},
+		"ports":    []interface{}{80},
+		"priority": "high",
+	}
+	assert.Equal(t, map[string]interface{}{
+		"added": map[string]interface{}{
+			"priority": "high",
+			"image":    map[string]interface{}{"pullPolicy": "Always"},
+		},
+		"removed": map[string]interface{}{
+			"debug": true,
+		},
+		"changed": map[string]interface{}{
+			"replicas": map[string]interface{}{"old": float64(1), "new": float64(3)},
+			"image":    map[string]interface{}{"tag": map[string]interface{}{"old": "1.23", "new": "1.25"}},
+		},
+	}, diffMaps(desired, current))
+
+	// Equal maps, including nested ones, have no differences.
+	empty := map[string]interface{}{
+		"added":   map[string]interface{}{},
+		"removed": map[string]interface{}{},
+		"changed": map[string]interface{}{},
+	}
+	assert.Equal(t, empty, diffMaps(desired, desired))
+	assert.Equal(t, empty, diffMaps(nil, map[string]interface{}{}))
+
+	// A map replaced by a scalar is a change.
+	assert.Equal(t, map[string]interface{}{"old": desired["image"], "new": "nginx"},
+		diffMaps(desired, map[string]interface{}{"image": "nginx"})["changed"].(map[string]interface{})["image"])
+
+	tpl := `{{ $d := diffMaps .a .b }}{{ if $d.changed }}{{ toJson $d.changed }}{{ end }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"a": map[string]interface{}{"x": 1}, "b": map[string]interface{}{"x": 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"x":{"new":2,"old":1}}`, b.String())
+}
+
+func TestFlattenMap(t *testing.T) {
+	values := map[string]interface{}{
+		"replicas": float64(2),
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.23"},
+		"ports": []interface{}{
+			map[string]interface{}{"name": "http", "port": float64(80)},
+			float64(443),
+		},
+		"extra":  map[string]interface{}{},
+		"labels": []interface{}{},
+		"nested": chartutil.Values{"deep": map[string]interface{}{"er": nil}},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"replicas":         float64(2),
+		"image.repository": "nginx",
+		"image.tag":        "1.23",
+		"ports.0.name":     "http",
+		"ports.0.port":     float64(80),
+		"ports.1":          float64(443),
+		"extra":            map[string]interface{}{},
+		"labels":           []interface{}{},
+		"nested.deep.er":   nil,
+	}, flattenMap(".", values))
+
+	assert.Equal(t, map[string]interface{}{
+		"image__repository": "nginx",
+		"image__tag":        "1.23",
+	}, flattenMap("__", map[string]interface{}{"image": values["image"]}))
+
+	assert.Empty(t, flattenMap(".", nil))
+
+	tpl := `{{ range $k, $v := flattenMap "_" .config }}{{ $k }}={{ $v }} {{ end }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"config": values["image"]})
+	assert.NoError(t, err)
+	assert.Equal(t, "repository=nginx tag=1.23 ", b.String())
+}
+
+func TestUnflattenMap(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"replicas": float64(2),
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.23"},
+		"ports": []interface{}{
+			map[string]interface{}{"name": "http", "port": float64(80)},
+			float64(443),
+		},
+		"sparse": map[string]interface{}{"0": "a", "2": "c"},
+		"padded": map[string]interface{}{"00": "a"},
+	}, unflattenMap(".", map[string]interface{}{
+		"replicas":         float64(2),
+		"image.repository": "nginx",
+		"image.tag":        "1.23",
+		"ports.0.name":     "http",
+		"ports.0.port":     float64(80),
+		"ports.1":          float64(443),
+		"sparse.0":         "a",
+		"sparse.2":         "c",
+		"padded.00":        "a",
+	}))
+
+	// The values of the flat map are not treated as parents.
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"b": map[string]interface{}{"c": "1"}},
+	}, unflattenMap("__", map[string]interface{}{"a__b": map[string]interface{}{"c": "1"}}))
+
+	// flattenMap and unflattenMap are inverses.
+	values := map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{"x", map[string]interface{}{"c": true}}},
+		"d": []interface{}{},
+	}
+	assert.Equal(t, values, unflattenMap("/", flattenMap("/", values)))
+
+	assert.Equal(t, map[string]interface{}{"Error": `key "a.b" is both a value and a parent of "a.b.c"`},
+		unflattenMap(".", map[string]interface{}{"a.b": "1", "a.b.c": "2"}))
+	assert.Equal(t, map[string]interface{}{"Error": `key "a" is both a value and a parent of "a.b"`},
+		unflattenMap(".", map[string]interface{}{"a": nil, "a.b": "2"}))
+	assert.Equal(t, map[string]interface{}{"Error": `key "a.b" is both a value and a parent of "a.b.c"`},
+		unflattenMap(".", map[string]interface{}{"a.b": map[string]interface{}{}, "a.b.c": "2"}))
+
+	tpl := `{{ unflattenMap "." .flat | toJson }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"flat": map[string]interface{}{"a.b.c": 1, "a.d.0": "x"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":{"b":{"c":1},"d":["x"]}}`, b.String())
+}
+
+func TestSortBy(t *testing.T) {
+	ports := []interface{}{
+		map[string]interface{}{"name": "https", "port": float64(443)},
+		map[string]interface{}{"name": "http", "port": 80},
+		map[string]interface{}{"name": "metrics"},
+		map[string]interface{}{"name": "admin", "port": float64(8080)},
+		map[string]interface{}{"name": "alt-http", "port": float64(80)},
+		"not a map",
+	}
+	out, err := sortBy("port", ports)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{ports[1], ports[4], ports[0], ports[3], ports[2], ports[5]}, out)
+
+	out, err = sortBy("name", ports)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{ports[3], ports[4], ports[1], ports[0], ports[2], ports[5]}, out)
+	assert.Equal(t, "https", ports[0].(map[string]interface{})["name"], "expected the list to be left alone")
+
+	type container struct {
+		Name     string
+		Priority int
+	}
+	containers := []container{{"b", 2}, {"a", 1}, {"c", 2}}
+	out, err = sortBy("Priority", containers)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{containers[1], containers[0], containers[2]}, out)
+
+	mixed := []interface{}{
+		map[string]interface{}{"port": "http"},
+		map[string]interface{}{"port": float64(80)},
+	}
+	_, err = sortBy("port", mixed)
+	assert.EqualError(t, err, `sortBy: cannot compare field "port": 80 (float64) and http (string) are not both numbers`)
+	_, err = sortBy("port", "not a list")
+	assert.Error(t, err)
+
+	tpl := `{{ range sortBy "port" .ports }}{{ .name }} {{ end }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"ports": ports[:5]})
+	assert.NoError(t, err)
+	assert.Equal(t, "http alt-http https admin metrics ", b.String())
+}
+
+func TestUniqBy(t *testing.T) {
+	ports := []interface{}{
+		map[string]interface{}{"port": float64(80), "name": "http"},
+		map[string]interface{}{"port": float64(443), "name": "https"},
+		map[string]interface{}{"port": 80, "name": "web"},
+		map[string]interface{}{"name": "unnamed"},
+		map[string]interface{}{"name": "unnamed"},
+	}
+	out, err := uniqBy("port", ports)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{ports[0], ports[1], ports[3], ports[4]}, out)
+
+	type container struct {
+		Name  string
+		Image string
+	}
+	containers := []container{{"app", "nginx:1"}, {"sidecar", "envoy:1"}, {"app", "nginx:2"}}
+	out, err = uniqBy("Name", containers)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{containers[0], containers[1]}, out)
+
+	_, err = uniqBy("port", 80)
+	assert.Error(t, err)
+
+	tpl := `{{ range uniqBy "port" .ports }}{{ .name }} {{ end }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"ports": ports})
+	assert.NoError(t, err)
+	assert.Equal(t, "http https unnamed unnamed ", b.String())
+}
+
+func TestYAMLOrdered(t *testing.T) {
+	in := `zookeeper:
+  servers: 3
+  tickTime: 2000
+apache:
+  modules:
+    - rewrite
+    - ssl
+  listen: &port 8080
+mysql:
+  port: *port
+  enabled: true
+`
+	m := fromYAMLOrdered(in)
+	var keys []string
+	for _, item := range m {
+		keys = append(keys, item.Key)
+	}
+	assert.Equal(t, []string{"zookeeper", "apache", "mysql"}, keys)
+	assert.Equal(t, 8080, m.Get("mysql").(orderedMap).Get("port"))
+	assert.Nil(t, m.Get("redis"))
+
+	expect := strings.Replace(strings.TrimSuffix(in, "\n"), "&port ", "", 1)
+	expect = strings.Replace(expect, "*port", "8080", 1)
+	assert.Equal(t, expect, toYAMLOrdered(m))
+
+	assert.Equal(t, "{}", toYAMLOrdered(fromYAMLOrdered("")))
+	assert.Contains(t, fromYAMLOrdered("a: [").Get("Error"), "yaml")
+	assert.Equal(t, "expected a map, got []interface {}", fromYAMLOrdered("- a").Get("Error"))
+
+	tpl := `{{ .cfg | fromYamlOrdered | toYamlOrdered }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"cfg": "z: 1\na: 2\nm: {y: 1, b: 2}\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, "z: 1\na: 2\nm:\n  y: 1\n  b: 2", b.String())
+}
+
+func TestMergeYAMLDocs(t *testing.T) {
+	base := `image:
+  repository: nginx
+  tag: "1.21"
+ports: [80]
+`
+	override := `image:
+  tag: "1.23"
+ports: [8080]
+---
+resources:
+  limits:
+    cpu: 500m
+`
+	assert.Equal(t, map[string]interface{}{
+		"image":     map[string]interface{}{"repository": "nginx", "tag": "1.23"},
+		"ports":     []interface{}{float64(8080)},
+		"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "500m"}},
+	}, mergeYAMLDocs(base, override))
+
+	// Null and empty documents are skipped.
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, mergeYAMLDocs("a: 1", "~", "", "---\n---\n"))
+
+	m := mergeYAMLDocs(base, "image: [unterminated\n")
+	assert.Contains(t, m, "Error")
+	assert.Len(t, m, 1)
+	assert.Contains(t, mergeYAMLDocs("- a\n- b\n"), "Error")
+
+	tpl := `{{ $m := mergeYamlDocs .base .override }}{{ $m.image.repository }}:{{ $m.image.tag }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]string{"base": base, "override": override})
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx:1.23", b.String())
+}
+
+func TestToKebabAndSnake(t *testing.T) {
+	for in, expect := range map[string]string{
+		"HTTPServer":      "http-server",
+		"myID":            "my-id",
+		"parseURL":        "parse-url",
+		"http-server":     "http-server",
+		"XMLHttpRequest":  "xml-http-request",
+		"APIVersion2":     "api-version2",
+		"already_snake":   "already-snake",
+		"Mixed Case--ish": "mixed-case-ish",
+		"":                "",
+	} {
+		assert.Equal(t, expect, toKebab(in), in)
+		assert.Equal(t, expect, toKebab(toKebab(in)), "idempotent for %s", in)
+		assert.Equal(t, strings.ReplaceAll(expect, "-", "_"), toSnake(in), in)
+	}
+
+	tpl := `{{ toKebab "HTTPServer" }} {{ toSnake "myID" }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http-server my_id", b.String())
+}
+
+func TestDeterministicPassword(t *testing.T) {
+	password, err := deterministicPassword("my-release/admin", 24)
+	assert.NoError(t, err)
+	assert.Len(t, password, 24)
+	assert.Regexp(t, "^[A-Za-z0-9]+$", password)
+
+	again, err := deterministicPassword("my-release/admin", 24)
+	assert.NoError(t, err)
+	assert.Equal(t, password, again)
+
+	other, err := deterministicPassword("other-release/admin", 24)
+	assert.NoError(t, err)
+	assert.NotEqual(t, password, other)
+
+	// A longer password starts with the shorter one.
+	long, err := deterministicPassword("my-release/admin", 100)
+	assert.NoError(t, err)
+	assert.Len(t, long, 100)
+	assert.True(t, strings.HasPrefix(long, password))
+
+	for _, length := range []int{0, -1, 1025} {
+		_, err := deterministicPassword("my-release/admin", length)
+		assert.Error(t, err, "length %d", length)
+	}
+
+	tpl := `{{ deterministicPassword (printf "%s/admin" .Release.Name) 24 }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"Release": map[string]interface{}{"Name": "my-release"}})
+	assert.NoError(t, err)
+	assert.Equal(t, password, b.String())
+}
+
+func TestHtpasswdReuse(t *testing.T) {
+	line, err := htpasswdReuse("admin", "s3cr3t", "")
+	assert.NoError(t, err)
+	user, hash, _ := strings.Cut(line, ":")
+	assert.Equal(t, "admin", user)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cr3t")))
+	assert.Error(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("wrong")))
+
+	// The previous line is kept while it matches.
+	again, err := htpasswdReuse("admin", "s3cr3t", line+"\n")
+	assert.NoError(t, err)
+	assert.Equal(t, line, again)
+
+	// A new password or user gets a new line.
+	changed, err := htpasswdReuse("admin", "n3w", line)
+	assert.NoError(t, err)
+	assert.NotEqual(t, line, changed)
+	_, hash, _ = strings.Cut(changed, ":")
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("n3w")))
+	other, err := htpasswdReuse("root", "s3cr3t", line)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(other, "root:"), other)
+	fresh, err := htpasswdReuse("admin", "s3cr3t", "admin:not a hash")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "admin:not a hash", fresh)
+
+	_, err = htpasswdReuse("ad:min", "s3cr3t", "")
+	assert.Error(t, err)
+	_, err = htpasswdReuse("admin", strings.Repeat("x", 73), "")
+	assert.Error(t, err)
+
+	tpl := `{{ htpasswdReuse "admin" "s3cr3t" .previous }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"previous": line})
+	assert.NoError(t, err)
+	assert.Equal(t, line, b.String())
+
+	// Sprig's htpasswd is left alone.
+	b.Reset()
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ htpasswd "admin" "s3cr3t" }}`)).Execute(&b, nil)
+	assert.NoError(t, err)
+	user, hash, _ = strings.Cut(b.String(), ":")
+	assert.Equal(t, "admin", user)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cr3t")))
+}
+
+func TestHtpasswdSeeded(t *testing.T) {
+	line, err := htpasswdSeeded("admin", "s3cr3t", "my-release")
+	assert.NoError(t, err)
+	user, hash, _ := strings.Cut(line, ":")
+	assert.Equal(t, "admin", user)
+	assert.True(t, strings.HasPrefix(hash, "$2a$10$"), hash)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cr3t")))
+	assert.Error(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("wrong")))
+
+	// The same seed gives the same line, and another seed or user a
+	// different salt.
+	again, err := htpasswdSeeded("admin", "s3cr3t", "my-release")
+	assert.NoError(t, err)
+	assert.Equal(t, line, again)
+	other, err := htpasswdSeeded("admin", "s3cr3t", "other-release")
+	assert.NoError(t, err)
+	assert.NotEqual(t, line, other)
+	root, err := htpasswdSeeded("root", "s3cr3t", "my-release")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash[:29], strings.TrimPrefix(root, "root:")[:29])
+
+	_, err = htpasswdSeeded("ad:min", "s3cr3t", "my-release")
+	assert.Error(t, err)
+	_, err = htpasswdSeeded("admin", strings.Repeat("x", 73), "my-release")
+	assert.Error(t, err)
+
+	tpl := template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ htpasswdSeeded "admin" "s3cr3t" .Release.Name }}`))
+	for i := 0; i < 2; i++ {
+		var b strings.Builder
+		err = tpl.Execute(&b, map[string]interface{}{"Release": map[string]interface{}{"Name": "my-release"}})
+		assert.NoError(t, err)
+		assert.Equal(t, line, b.String())
+	}
+}
+
+func TestWrapChunks(t *testing.T) {
+	for _, tt := range []struct {
+		width  int
+		in     string
+		expect string
+	}{
+		{4, "abcdefgh", "abcd\nefgh"},
+		{3, "abcdefgh", "abc\ndef\ngh"},
+		{10, "abc", "abc"},
+		{0, "abcdefgh", "abcdefgh"},
+		{-1, "abcdefgh", "abcdefgh"},
+		{2, "", ""},
+		{2, "héllo wörld", "hé\nll\no \nwö\nrl\nd"},
+		{1, "日本", "日\n本"},
+	} {
+		assert.Equal(t, tt.expect, wrapChunks(tt.width, tt.in), "wrapChunks %d %q", tt.width, tt.in)
+	}
+
+	// Sprig's chunk, which splits a list, is left alone.
+	tpl := `{{ "0123456789" | wrapChunks 4 }} {{ chunk 2 (list 1 2 3) }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123\n4567\n89 [[1 2] [3]]", b.String())
+}
+
+func TestIndentRest(t *testing.T) {
+	for _, tt := range []struct {
+		in, expect string
+	}{
+		{"single line", "single line"},
+		{"", ""},
+		{"first\nsecond\nthird", "first\n  second\n  third"},
+		{"first\n\nthird", "first\n\n  third"},
+		{"first\nsecond\n", "first\n  second\n"},
+		{"first\n", "first\n"},
+	} {
+		assert.Equal(t, tt.expect, indentRest(2, tt.in), "indentRest 2 %q", tt.in)
+	}
+
+	tpl := "command: {{ indentRest 2 .script }}"
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"script": "|\nset -e\nrun\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, "command: |\n  set -e\n  run\n", b.String())
+}
+
+func TestParseSelector(t *testing.T) {
+	sel := parseSelector("app=web,tier!=db,env in (staging,prod),canary,!legacy")
+	assert.Equal(t, map[string]interface{}{
+		"matchLabels": map[string]interface{}{"app": "web"},
+		"matchExpressions": []interface{}{
+			map[string]interface{}{"key": "canary", "operator": "Exists"},
+			map[string]interface{}{"key": "env", "operator": "In", "values": []interface{}{"prod", "staging"}},
+			map[string]interface{}{"key": "legacy", "operator": "DoesNotExist"},
+			map[string]interface{}{"key": "tier", "operator": "NotIn", "values": []interface{}{"db"}},
+		},
+	}, sel)
+
+	assert.Equal(t, map[string]interface{}{
+		"matchLabels":      map[string]interface{}{"app": "web", "tier": "frontend"},
+		"matchExpressions": []interface{}{},
+	}, parseSelector("app==web, tier=frontend"))
+
+	assert.Equal(t, map[string]interface{}{
+		"matchLabels":      map[string]interface{}{},
+		"matchExpressions": []interface{}{},
+	}, parseSelector(""))
+
+	for _, malformed := range []string{"app=web,", "env in (prod", "a b", "-app=web"} {
+		sel := parseSelector(malformed)
+		assert.Len(t, sel, 1, malformed)
+		assert.Contains(t, sel["Error"], fmt.Sprintf("invalid selector %q", malformed))
+	}
+	assert.Equal(t, map[string]interface{}{
+		"Error": `invalid selector "replicas>3": operator "gt" is not supported in label selectors`,
+	}, parseSelector("replicas>3"))
+
+	tpl := `{{ parseSelector .selector | toYaml }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"selector": "app=web,tier notin (db)"})
+	assert.NoError(t, err)
+	assert.Equal(t, "matchExpressions:\n- key: tier\n  operator: NotIn\n  values:\n  - db\nmatchLabels:\n  app: web", b.String())
+}
+
+func TestToYAMLTyped(t *testing.T) {
+	type probe struct {
+		Path    string `yaml:"httpPath" json:"path"`
+		Port    int    `json:"port"`
+		Timeout int    `yaml:"timeoutSeconds,omitempty" json:"timeout,omitempty"`
+	}
+	type container struct {
+		Name  string `yaml:"name"`
+		Probe *probe `yaml:"readinessProbe" json:"probe"`
+	}
+	c := container{Name: "web", Probe: &probe{Path: "/healthz", Port: 8080}}
+
+	assert.Equal(t, "name: web\nreadinessProbe:\n  httpPath: /healthz\n  port: 8080", toYAMLTyped(c))
+	// toYaml goes through JSON, so it uses the json tags, and the field names
+	// where there are none.
+	assert.Equal(t, "Name: web\nprobe:\n  path: /healthz\n  port: 8080", toYAML(c))
+
+	assert.Equal(t, "a: 1\nb:\n  - x", toYAMLTyped(map[string]interface{}{"b": []string{"x"}, "a": 1}))
+	assert.Equal(t, "", toYAMLTyped(func() {}))
+
+	tpl := `{{ .container | toYamlTyped }}`
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"container": c})
+	assert.NoError(t, err)
+	assert.Equal(t, toYAMLTyped(c), b.String())
+}
+
+func TestNormalizeImage(t *testing.T) {
+	for ref, expect := range map[string]string{
+		"nginx":                                 "docker.io/library/nginx:latest",
+		"nginx:1.25":                            "docker.io/library/nginx:1.25",
+		"bitnami/redis:7.0":                     "docker.io/bitnami/redis:7.0",
+		"quay.io/prometheus/node-exporter":      "quay.io/prometheus/node-exporter:latest",
+		"localhost:5000/app":                    "localhost:5000/app:latest",
+		"registry.example.com:8443/team/app:v2": "registry.example.com:8443/team/app:v2",
+		"nginx@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31": "docker.io/library/nginx@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31",
+	} {
+		out, err := normalizeImage(ref)
+		assert.NoError(t, err, ref)
+		assert.Equal(t, expect, out, ref)
+	}
+
+	_, err := normalizeImage("nginx:1.25@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31")
+	assert.EqualError(t, err, `invalid image reference "nginx:1.25@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31": it has both a tag and a digest`)
+	for _, invalid := range []string{"", "registry.example.com//app", "Nginx", "nginx:", "nginx@sha256:abc"} {
+		_, err := normalizeImage(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	tpl := `{{ printf "%s/%s" .registry .repository | normalizeImage }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"registry": "localhost:5000", "repository": "app"})
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:5000/app:latest", b.String())
+}
+
+func TestB32Lower(t *testing.T) {
+	binary := string([]byte{0x00, 0xff, 0x10, 0x80, 0x7f, 0x3c, 0x2f, 0x2b, 0x3d})
+	for _, in := range []string{"", "f", "foobar", "Hello, World!", binary} {
+		enc := b32encLower(in)
+		assert.Regexp(t, "^[a-z2-7]*$", enc)
+		dec, err := b32decLower(enc)
+		assert.NoError(t, err)
+		assert.Equal(t, in, dec)
+	}
+	assert.Equal(t, "mzxw6ytboi", b32encLower("foobar"))
+
+	// Upper case and padded input from other encoders is accepted.
+	dec, err := b32decLower("MZXW6YTBOI======")
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar", dec)
+
+	_, err = b32decLower("not base32!")
+	assert.Error(t, err)
+
+	// Sprig's b32enc and b32dec are left alone.
+	tpl := `{{ "foobar" | b32encLower }} {{ "mzxw6ytboi" | b32decLower }} {{ "foobar" | b32enc }} {{ "MZXW6YTBOI======" | b32dec }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "mzxw6ytboi foobar MZXW6YTBOI====== foobar", b.String())
+}
+
+func TestToDotenv(t *testing.T) {
+	env := map[string]interface{}{
+		"LOG_LEVEL":    "debug",
+		"greeting":     "hello world",
+		"DSN":          "postgres://db:5432/app?sslmode=disable",
+		"OPTS":         "a=b",
+		"MOTD":         "line one\nline \"two\"",
+		"PRICE":        "$5 \\ each",
+		"PORT":         float64(8080),
+		"ENABLED":      true,
+		"EMPTY":        nil,
+		"URL":          "https://example.com/path",
+		"_PRIVATE_KEY": "",
+	}
+	out, err := toDotenv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		`DSN="postgres://db:5432/app?sslmode=disable"`,
+		`EMPTY=`,
+		`ENABLED=true`,
+		`LOG_LEVEL=debug`,
+		`MOTD="line one\nline \"two\""`,
+		`OPTS="a=b"`,
+		`PORT=8080`,
+		`PRICE="\$5 \\ each"`,
+		`URL=https://example.com/path`,
+		`_PRIVATE_KEY=`,
+		`greeting="hello world"`,
+	}, "\n"), out)
+
+	out, err = toDotenv(map[string]interface{}{"log_level": "debug", "Port": 80}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "LOG_LEVEL=debug\nPORT=80", out)
+
+	out, err = toDotenv(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", out)
+
+	_, err = toDotenv(map[string]interface{}{"log-level": "debug"}, true)
+	assert.EqualError(t, err, `toDotenv: "log-level" is not a valid variable name`)
+	_, err = toDotenv(map[string]interface{}{"1ST": "x"})
+	assert.Error(t, err)
+	_, err = toDotenv(map[string]interface{}{"port": 80, "PORT": 8080}, true)
+	assert.Error(t, err)
+
+	tpl := `{{ toDotenv .env true }}`
+	var b strings.Builder
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"env": map[string]interface{}{"name": "my app"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `NAME="my app"`, b.String())
+}
+
+func TestWordWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		text   string
+		expect string
+	}{
+		{"long line", 20, "The quick brown fox jumps over the lazy dog", "The quick brown fox\njumps over the lazy\ndog"},
+		{"exact width", 9, "abcd efgh ijkl", "abcd efgh\nijkl"},
+		{"newlines", 10, "first line here\n\nsecond  line", "first line\nhere\n\nsecond\nline"},
+		{"long word", 5, "a supercalifragilistic b", "a\nsupercalifragilistic\nb"},
+		{"runes", 5, "héllo wörld", "héllo\nwörld"},
+		{"zero width", 0, "keep  as\tis ", "keep  as\tis "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, wordWrap(tt.width, tt.text))
+		})
+	}
+
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ . | wordWrap 8 }}`)).Execute(&b, "one two three")
+	assert.NoError(t, err)
+	assert.Equal(t, "one two\nthree", b.String())
+}
+
+func TestToBool(t *testing.T) {
+	tests := []struct {
+		in     interface{}
+		expect bool
+	}{
+		{true, true},
+		{false, false},
+		{"yes", true},
+		{" On ", true},
+		{"TRUE", true},
+		{"Off", false},
+		{"n", false},
+		{"", false},
+		{nil, false},
+		{1, true},
+		{0, false},
+		{float64(1), true},
+		{int64(0), false},
+	}
+	for _, tt := range tests {
+		got, err := toBool(tt.in)
+		assert.NoError(t, err, "%#v", tt.in)
+		assert.Equal(t, tt.expect, got, "%#v", tt.in)
+	}
+
+	for _, in := range []interface{}{"enabled", "ture", 2, []interface{}{}} {
+		_, err := toBool(in)
+		assert.Error(t, err, "%#v", in)
+	}
+	_, err := toBool("ture")
+	assert.EqualError(t, err, `cannot interpret "ture" as a boolean`)
+
+	var b strings.Builder
+	tpl := `{{ if toBool .a }}a{{ end }}{{ if toBool .b }}b{{ end }}`
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&b, map[string]interface{}{"a": "yes", "b": 0})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", b.String())
+
+	// A value that is not a boolean fails the render.
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ if toBool . }}on{{ end }}`)).Execute(&b, "maybe")
+	assert.Error(t, err)
+}
+
+func TestCIDRHost(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		n      interface{}
+		expect string
+	}{
+		{"10.96.0.0/12", 10, "10.96.0.10"},
+		{"10.96.0.0/12", float64(1), "10.96.0.1"},
+		{"10.0.0.0/24", 254, "10.0.0.254"},
+		// The host bits of the CIDR are ignored.
+		{"192.168.1.77/24", 44, "192.168.1.44"},
+		{"10.0.0.0/16", 256, "10.0.1.0"},
+		{"10.0.0.4/31", 0, "10.0.0.4"},
+		{"10.0.0.4/32", 0, "10.0.0.4"},
+		{"fd00:10:96::/108", 10, "fd00:10:96::a"},
+		{"2001:db8::/64", 65536, "2001:db8::1:0"},
+	}
+	for _, tt := range tests {
+		got, err := cidrHost(tt.cidr, tt.n)
+		assert.NoError(t, err, tt.cidr)
+		assert.Equal(t, tt.expect, got, "%s %v", tt.cidr, tt.n)
+	}
+
+	for _, tt := range []struct {
+		cidr string
+		n    interface{}
+	}{
+		{"10.0.0.0/24", 0},
+		{"10.0.0.0/24", 255},
+		{"10.0.0.0/24", -1},
+		{"10.0.0.0/31", 2},
+		{"fd00::/120", 256},
+		{"10.0.0.0/24", 1.5},
+		{"10.0.0.0", 1},
+	} {
+		_, err := cidrHost(tt.cidr, tt.n)
+		assert.Error(t, err, "%s %v", tt.cidr, tt.n)
+	}
+
+	var b strings.Builder
+	err := template.Must(template.New("test").Funcs(funcMap()).Parse(`{{ cidrHost . 10 }}`)).Execute(&b, "10.96.0.0/12")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.96.0.10", b.String())
+}
+
+func TestCIDRContains(t *testing.T) {
+	tests := []struct {
+		cidr, ip string
+		expect   bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"192.168.0.0/16", "192.168.255.255", true},
+		{"fd00::/8", "fd12::1", true},
+		{"fd00::/8", "fe80::1", false},
+		{"10.0.0.0/8", "fd00::1", false},
+	}
+	for _, tt := range tests {
+		got, err := cidrContains(tt.cidr, tt.ip)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, got, "%s %s", tt.cidr, tt.ip)
+	}
+
+	_, err := cidrContains("10.0.0.0/33", "10.0.0.1")
+	assert.Error(t, err)
+	_, err = cidrContains("10.0.0.0/8", "10.0.0.256")
+	assert.Error(t, err)
+}
+
+func TestSetOperations(t *testing.T) {
+	a := []string{"web", "api", "web", "db"}
+	b := []interface{}{"api", "cache", "db"}
+	c := []string{"queue"}
+
+	tests := []struct {
+		name                     string
+		lists                    []interface{}
+		union, intersect, differ []string
+	}{
+		{"overlapping", []interface{}{a, b}, []string{"api", "cache", "db", "web"}, []string{"api", "db"}, []string{"web"}},
+		{"disjoint", []interface{}{a, c}, []string{"api", "db", "queue", "web"}, []string{}, []string{"api", "db", "web"}},
+		{"three", []interface{}{a, b, []string{"db"}}, []string{"api", "cache", "db", "web"}, []string{"db"}, []string{"web"}},
+		{"empty", []interface{}{[]string{}, a}, []string{"api", "db", "web"}, []string{}, []string{}},
+		{"nil", []interface{}{a, nil}, []string{"api", "db", "web"}, []string{}, []string{"api", "db", "web"}},
+		{"numbers", []interface{}{[]interface{}{float64(8080), 443}, []string{"443"}}, []string{"443", "8080"}, []string{"443"}, []string{"8080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			union, err := setUnion(tt.lists...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.union, union)
+			intersect, err := setIntersect(tt.lists...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.intersect, intersect)
+			difference, err := setDifference(tt.lists[0], tt.lists[1:]...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.differ, difference)
+		})
+	}
+
+	_, err := setUnion(a, "api")
+	assert.Error(t, err)
+
+	var out strings.Builder
+	tpl := `{{ setIntersect .a .b | join "," }} {{ setDifference .a .b | join "," }}`
+	err = template.Must(template.New("test").Funcs(funcMap()).Parse(tpl)).Execute(&out, map[string]interface{}{"a": a, "b": b})
+	assert.NoError(t, err)
+	assert.Equal(t, "api,db web", out.String())
+}
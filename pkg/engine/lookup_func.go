@@ -24,6 +24,8 @@ import (
 	"github.com/pkg/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
@@ -77,6 +79,77 @@ func NewLookupFunction(config *rest.Config) lookupFunc {
 	}
 }
 
+type lookupListFunc = func(apiversion string, resource string, namespace string, selector string) ([]interface{}, error)
+
+// newLookupListFunction returns a function for listing the objects in the
+// cluster that match a label selector.
+//
+// An empty selector matches every object. If the resource does not exist, an
+// empty list is returned and no error is raised.
+func newLookupListFunction(config *rest.Config) lookupListFunc {
+	return func(apiversion string, resource string, namespace string, selector string) ([]interface{}, error) {
+		list, err := listObjects(config, apiversion, resource, namespace, metav1.ListOptions{LabelSelector: selector})
+		if err != nil || list == nil {
+			return []interface{}{}, err
+		}
+		items := make([]interface{}, 0, len(list.Items))
+		for _, item := range list.Items {
+			items = append(items, item.UnstructuredContent())
+		}
+		return items, nil
+	}
+}
+
+// newLookupWithSelectorFunction returns a function for listing the objects in
+// the cluster that match a field selector, such as "status.phase=Running".
+//
+// The result has the same shape as a lookup without a name. If the resource
+// does not exist, no error is raised.
+func newLookupWithSelectorFunction(config *rest.Config) lookupFunc {
+	return func(apiversion string, resource string, namespace string, selector string) (map[string]interface{}, error) {
+		if err := validateFieldSelector(selector); err != nil {
+			return map[string]interface{}{}, err
+		}
+		list, err := listObjects(config, apiversion, resource, namespace, metav1.ListOptions{FieldSelector: selector})
+		if err != nil || list == nil {
+			return map[string]interface{}{}, err
+		}
+		return list.UnstructuredContent(), nil
+	}
+}
+
+// validateFieldSelector returns an error if selector is not a well-formed field
+// selector. The empty selector is valid and matches everything.
+func validateFieldSelector(selector string) error {
+	if _, err := fields.ParseSelector(selector); err != nil {
+		return errors.Wrapf(err, "invalid field selector %q", selector)
+	}
+	return nil
+}
+
+// listObjects lists the objects of the given kind. A nil list and no error are
+// returned when the resource does not exist.
+func listObjects(config *rest.Config, apiversion string, resource string, namespace string, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	var client dynamic.ResourceInterface
+	c, namespaced, err := getDynamicClientOnKind(apiversion, resource, config)
+	if err != nil {
+		return nil, err
+	}
+	if namespaced && namespace != "" {
+		client = c.Namespace(namespace)
+	} else {
+		client = c
+	}
+	list, err := client.List(context.Background(), opts)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list, nil
+}
+
 // getDynamicClientOnUnstructured returns a dynamic client on an Unstructured type. This client can be further namespaced.
 func getDynamicClientOnKind(apiversion string, kind string, config *rest.Config) (dynamic.NamespaceableResourceInterface, bool, error) {
 	gvk := schema.FromAPIVersionAndKind(apiversion, kind)
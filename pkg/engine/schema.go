@@ -0,0 +1,107 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// DefaultsFromSchema builds the values described by the `default` entries of
+// the chart's values.schema.json, at every level of nesting. Objects without
+// any defaults are left out. A chart without a schema has no defaults.
+//
+// An object's own default takes precedence over the defaults of its
+// properties, which only fill in the keys it does not set. Likewise, the
+// defaults of an array's items fill in the objects of the array's default.
+//
+// References ($ref) and combinators such as allOf are not followed.
+func (e Engine) DefaultsFromSchema(chrt *chart.Chart) (chartutil.Values, error) {
+	vals := chartutil.Values{}
+	if len(chrt.Schema) == 0 {
+		return vals, nil
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(chrt.Schema, &schema); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the schema of chart %s", chrt.Name())
+	}
+	if d, ok := schemaDefault(schema); ok {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("the schema of chart %s has a default that is not an object", chrt.Name())
+		}
+		vals = m
+	}
+	return vals, nil
+}
+
+// schemaDefault returns the default value described by schema, if any.
+func schemaDefault(schema map[string]interface{}) (interface{}, bool) {
+	d, ok := schema["default"]
+	if !ok {
+		if _, ok := schema["properties"]; !ok {
+			return nil, false
+		}
+		m := fillDefaults(map[string]interface{}{}, schema)
+		if len(m) == 0 {
+			return nil, false
+		}
+		return m, true
+	}
+
+	switch v := d.(type) {
+	case map[string]interface{}:
+		return fillDefaults(v, schema), true
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					v[i] = fillDefaults(m, items)
+				}
+			}
+		}
+	}
+	return d, true
+}
+
+// fillDefaults sets the defaults of the properties of schema on every key of m
+// that is not set yet.
+func fillDefaults(m map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	props, _ := schema["properties"].(map[string]interface{})
+	for k, p := range props {
+		ps, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, set := m[k]; set {
+			// Fill in nested objects the default only partially sets.
+			if nested, ok := m[k].(map[string]interface{}); ok {
+				m[k] = fillDefaults(nested, ps)
+			}
+			continue
+		}
+		if d, ok := schemaDefault(ps); ok {
+			m[k] = d
+		}
+	}
+	return m
+}
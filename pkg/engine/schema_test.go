@@ -0,0 +1,117 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func TestDefaultsFromSchema(t *testing.T) {
+	schema := `{
+  "type": "object",
+  "properties": {
+    "replicaCount": {"type": "integer", "default": 1},
+    "image": {
+      "type": "object",
+      "properties": {
+        "repository": {"type": "string", "default": "nginx"},
+        "tag": {"type": "string"},
+        "pullPolicy": {"type": "string", "default": "IfNotPresent"}
+      }
+    },
+    "service": {
+      "type": "object",
+      "default": {"type": "ClusterIP"},
+      "properties": {
+        "type": {"type": "string", "default": "NodePort"},
+        "port": {"type": "integer", "default": 80}
+      }
+    },
+    "ports": {
+      "type": "array",
+      "default": [{"name": "http"}, {"name": "dns", "protocol": "UDP"}],
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "protocol": {"type": "string", "default": "TCP"}
+        }
+      }
+    },
+    "tolerations": {"type": "array", "default": []},
+    "extra": {
+      "type": "object",
+      "properties": {
+        "annotations": {"type": "object"}
+      }
+    }
+  }
+}`
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "moby", Version: "1.2.3"},
+		Schema:   []byte(schema),
+	}
+
+	vals, err := new(Engine).DefaultsFromSchema(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := chartutil.Values{
+		"replicaCount": float64(1),
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"pullPolicy": "IfNotPresent",
+		},
+		"service": map[string]interface{}{
+			"type": "ClusterIP",
+			"port": float64(80),
+		},
+		"ports": []interface{}{
+			map[string]interface{}{"name": "http", "protocol": "TCP"},
+			map[string]interface{}{"name": "dns", "protocol": "UDP"},
+		},
+		"tolerations": []interface{}{},
+	}
+	if !reflect.DeepEqual(vals, expect) {
+		t.Errorf("Expected %v, got %v", expect, vals)
+	}
+}
+
+func TestDefaultsFromSchemaErrors(t *testing.T) {
+	c := &chart.Chart{Metadata: &chart.Metadata{Name: "moby", Version: "1.2.3"}}
+	vals, err := new(Engine).DefaultsFromSchema(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 0 {
+		t.Errorf("Expected no defaults without a schema, got %v", vals)
+	}
+
+	c.Schema = []byte(`{"type": "object",`)
+	if _, err := new(Engine).DefaultsFromSchema(c); err == nil {
+		t.Error("Expected an error for a malformed schema")
+	}
+
+	c.Schema = []byte(`{"default": [1, 2]}`)
+	if _, err := new(Engine).DefaultsFromSchema(c); err == nil {
+		t.Error("Expected an error for a schema whose default is not an object")
+	}
+}
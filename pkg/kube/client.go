@@ -49,7 +49,6 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	cachetools "k8s.io/client-go/tools/cache"
 	watchtools "k8s.io/client-go/tools/watch"
-	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 )
 
 // ErrNoObjectsVisited indicates that during a visit operation, no matching objects were found.
@@ -89,7 +88,7 @@ func New(getter genericclioptions.RESTClientGetter) *Client {
 		}
 	})
 	return &Client{
-		Factory: cmdutil.NewFactory(getter),
+		Factory: NewCachedFactory(getter),
 		Log:     nopLogger,
 	}
 }
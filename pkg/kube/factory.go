@@ -17,11 +17,40 @@ limitations under the License.
 package kube // import "helm.sh/helm/v3/pkg/kube"
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	cachetools "k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/transport"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/validation"
 )
 
@@ -46,3 +75,750 @@ type Factory interface {
 	// OpenAPIGetter returns a getter for the openapi schema document
 	OpenAPIGetter() discovery.OpenAPISchemaInterface
 }
+
+// CachedFactory is a Factory that keeps the results of API discovery in memory,
+// so that resolving many resources within a single operation does not repeat
+// the same discovery requests against the API server.
+type CachedFactory struct {
+	cmdutil.Factory
+
+	getter *cachedDiscoveryGetter
+}
+
+// NewCachedFactory returns a CachedFactory for the cluster described by getter.
+func NewCachedFactory(getter genericclioptions.RESTClientGetter) *CachedFactory {
+	g := &cachedDiscoveryGetter{RESTClientGetter: getter}
+	return &CachedFactory{
+		Factory: cmdutil.NewFactory(g),
+		getter:  g,
+	}
+}
+
+// NewCachedFactoryFromKubeconfig returns a CachedFactory for the cluster
+// described by the current context of kubeconfig, the contents of a kubeconfig
+// file. Nothing is read from the filesystem or the environment.
+func NewCachedFactoryFromKubeconfig(kubeconfig []byte) (*CachedFactory, error) {
+	config, err := clientcmd.NewClientConfigFromBytes(kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kubeconfig")
+	}
+	return NewCachedFactory(&clientConfigGetter{config: config}), nil
+}
+
+// Invalidate discards the cached discovery results, so that the next lookup
+// fetches them from the API server again. Callers that have just applied a
+// CustomResourceDefinition must invalidate before using the new kind.
+func (f *CachedFactory) Invalidate() {
+	f.getter.invalidate()
+}
+
+// WithWarningHandler sets the handler for the warnings the API server returns
+// to the clients created by f, such as those for deprecated APIs, and returns
+// f. By default they are logged. Use rest.NoWarnings{} to silence them, or a
+// handler of your own to collect them.
+func (f *CachedFactory) WithWarningHandler(h rest.WarningHandler) *CachedFactory {
+	f.getter.warningHandler = h
+	return f
+}
+
+// WithTransportWrapper adds wrap to the transports of the clients created by f,
+// such as the ones returned by KubernetesClientSet and DynamicClient, and
+// returns f. It can be used to inject credentials into every request, for
+// example. Calling it again adds another wrapper around the previous ones.
+func (f *CachedFactory) WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) *CachedFactory {
+	f.getter.wrapTransport = transport.Wrappers(f.getter.wrapTransport, wrap)
+	return f
+}
+
+// WithServerOverride makes the clients created by f, including the discovery
+// client, connect to the API server at url instead of the one in the
+// kubeconfig, and returns f. The credentials and TLS settings of the kubeconfig
+// are kept, such as to connect through a local proxy. It must be called before
+// f is used.
+func (f *CachedFactory) WithServerOverride(url string) *CachedFactory {
+	f.getter.serverOverride = url
+	return f
+}
+
+// WithCredentialRefresh makes the clients created by f retry a request once
+// when the API server responds with 401 Unauthorized, such as when a token
+// expires during a long operation, and returns f. Before the retry, refresh is
+// called to renew the credentials, for example by discarding a cached token.
+// Credentials from exec plugins are renewed by client-go itself after a 401,
+// so refresh may be nil. If refresh fails, its error is returned instead of
+// retrying.
+func (f *CachedFactory) WithCredentialRefresh(refresh func(ctx context.Context) error) *CachedFactory {
+	f.getter.retryUnauthorized = true
+	f.getter.refreshCredentials = refresh
+	return f
+}
+
+// Errors returned by Ping, wrapping the error of the request that failed.
+var (
+	// ErrClusterUnreachable indicates that the API server could not be
+	// reached, or did not respond as an API server.
+	ErrClusterUnreachable = errors.New("Kubernetes cluster unreachable")
+	// ErrUnauthorized indicates that the API server rejected the credentials,
+	// which are usually missing or expired.
+	ErrUnauthorized = errors.New("Kubernetes cluster rejected the credentials")
+	// ErrForbidden indicates that the credentials were accepted, but RBAC
+	// does not allow the request.
+	ErrForbidden = errors.New("Kubernetes cluster denied access")
+)
+
+// Ping checks that the cluster is reachable and accepts the credentials of f by
+// requesting the server version, and returns an error that wraps
+// ErrClusterUnreachable, ErrUnauthorized or ErrForbidden if it does not. Use it
+// to fail fast before an operation that changes the cluster.
+func (f *CachedFactory) Ping(ctx context.Context) error {
+	config, err := f.ToRESTConfig()
+	if err != nil {
+		return errors.Wrap(ErrClusterUnreachable, err.Error())
+	}
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return errors.Wrap(ErrClusterUnreachable, err.Error())
+	}
+	return ping(ctx, client.RESTClient())
+}
+
+func ping(ctx context.Context, client rest.Interface) error {
+	err := client.Get().AbsPath("/version").Do(ctx).Error()
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsUnauthorized(err):
+		return errors.Wrap(ErrUnauthorized, err.Error())
+	case apierrors.IsForbidden(err):
+		return errors.Wrap(ErrForbidden, err.Error())
+	default:
+		return errors.Wrap(ErrClusterUnreachable, err.Error())
+	}
+}
+
+// clientConfigGetter is a RESTClientGetter for a loaded kubeconfig.
+type clientConfigGetter struct {
+	config clientcmd.ClientConfig
+}
+
+func (g *clientConfigGetter) ToRESTConfig() (*rest.Config, error) {
+	return g.config.ClientConfig()
+}
+
+func (g *clientConfigGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	config, err := g.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *clientConfigGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	dc, err := g.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	return restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(dc), dc), nil
+}
+
+func (g *clientConfigGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return g.config
+}
+
+// cachedDiscoveryGetter wraps a RESTClientGetter so that its discovery client
+// and REST mapper share a single in-memory cache.
+type cachedDiscoveryGetter struct {
+	genericclioptions.RESTClientGetter
+
+	mu        sync.Mutex
+	delegate  discovery.CachedDiscoveryInterface
+	discovery discovery.CachedDiscoveryInterface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+
+	warningHandler     rest.WarningHandler
+	wrapTransport      transport.WrapperFunc
+	retryUnauthorized  bool
+	refreshCredentials func(ctx context.Context) error
+	serverOverride     string
+
+	transportMu sync.Mutex
+	transport   http.RoundTripper
+}
+
+func (g *cachedDiscoveryGetter) ToRESTConfig() (*rest.Config, error) {
+	config, err := g.restConfig()
+	if err != nil || !g.retryUnauthorized {
+		return config, err
+	}
+
+	// A wrapper added with Wrap sees requests before the credentials are
+	// added, so the retry wraps the complete transport instead, which adds
+	// them again to the retried request.
+	rt, err := g.retryingTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	retrying := rest.AnonymousClientConfig(config)
+	retrying.TLSClientConfig = rest.TLSClientConfig{}
+	retrying.Transport = rt
+	return retrying, nil
+}
+
+// restConfig returns the config of the wrapped getter with the settings of
+// the factory applied, except for the retry of unauthorized requests, which
+// replaces its credentials and TLS settings with a transport.
+func (g *cachedDiscoveryGetter) restConfig() (*rest.Config, error) {
+	config, err := g.RESTClientGetter.ToRESTConfig()
+	if err != nil || (g.warningHandler == nil && g.wrapTransport == nil && g.serverOverride == "") {
+		return config, err
+	}
+	config = rest.CopyConfig(config)
+	if g.serverOverride != "" {
+		config.Host = g.serverOverride
+	}
+	if g.warningHandler != nil {
+		config.WarningHandler = g.warningHandler
+	}
+	if g.wrapTransport != nil {
+		config.Wrap(g.wrapTransport)
+	}
+	return config, nil
+}
+
+// retryingTransport returns the transport that retries unauthorized requests
+// made with config. It is built once, so that every client of the factory
+// shares its connections and credentials, like the clients that client-go
+// builds from equal configs do.
+func (g *cachedDiscoveryGetter) retryingTransport(config *rest.Config) (http.RoundTripper, error) {
+	g.transportMu.Lock()
+	defer g.transportMu.Unlock()
+	if g.transport != nil {
+		return g.transport, nil
+	}
+	rt, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+	g.transport = &unauthorizedRetrier{next: rt, refresh: g.refreshCredentials}
+	return g.transport, nil
+}
+
+// unauthorizedRetrier retries a request once if the response is 401
+// Unauthorized, after calling refresh.
+type unauthorizedRetrier struct {
+	next    http.RoundTripper
+	refresh func(ctx context.Context) error
+}
+
+func (rt *unauthorizedRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// A request whose body cannot be read again cannot be retried.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	if rt.refresh != nil {
+		if err := rt.refresh(req.Context()); err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrap(err, "failed to refresh credentials")
+		}
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return rt.next.RoundTrip(retry)
+}
+
+// init creates the cached discovery client and REST mapper on first use. An
+// error is not kept, so that the next call tries again after a temporary
+// failure to reach the API server.
+func (g *cachedDiscoveryGetter) init() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.discovery != nil {
+		return nil
+	}
+	delegate, err := g.delegateDiscoveryClient()
+	if err != nil {
+		return err
+	}
+	g.delegate = delegate
+	g.discovery = memory.NewMemCacheClient(delegate)
+	g.mapper = restmapper.NewDeferredDiscoveryRESTMapper(g.discovery)
+	return nil
+}
+
+// delegateDiscoveryClient returns the discovery client of the wrapped getter,
+// unless the server is overridden, which it does not know about.
+func (g *cachedDiscoveryGetter) delegateDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	if g.serverOverride == "" {
+		return g.RESTClientGetter.ToDiscoveryClient()
+	}
+	config, err := g.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *cachedDiscoveryGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	if err := g.init(); err != nil {
+		return nil, err
+	}
+	return g.discovery, nil
+}
+
+func (g *cachedDiscoveryGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	if err := g.init(); err != nil {
+		return nil, err
+	}
+	return restmapper.NewShortcutExpander(g.mapper, g.discovery), nil
+}
+
+func (g *cachedDiscoveryGetter) invalidate() {
+	if err := g.init(); err != nil {
+		return
+	}
+	// The wrapped client may keep a cache of its own, such as the on-disk
+	// cache used by the kubectl flags, so it is invalidated as well.
+	g.delegate.Invalidate()
+	g.mapper.Reset()
+}
+
+// GroupVersionKindName identifies a single object in the cluster.
+type GroupVersionKindName struct {
+	schema.GroupVersionKind
+	Namespace string
+	Name      string
+}
+
+// getManyConcurrency bounds the number of requests GetMany has in flight.
+const getManyConcurrency = 8
+
+// GetMany fetches the objects identified by refs from the cluster, issuing the
+// requests concurrently.
+//
+// The results are positional: for each ref, either the object at the same index
+// is set or the error at the same index describes why it could not be fetched.
+func (f *CachedFactory) GetMany(refs []GroupVersionKindName) ([]map[string]interface{}, []error) {
+	return getMany(f, refs)
+}
+
+func getMany(f Factory, refs []GroupVersionKindName) ([]map[string]interface{}, []error) {
+	objs := make([]map[string]interface{}, len(refs))
+	errs := make([]error, len(refs))
+
+	sem := make(chan struct{}, getManyConcurrency)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ref GroupVersionKindName) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			objs[i], errs[i] = getObject(f, ref)
+		}(i, ref)
+	}
+	wg.Wait()
+	return objs, errs
+}
+
+func getObject(f Factory, ref GroupVersionKindName) (map[string]interface{}, error) {
+	// Kind.version.group is unambiguous for the builder, even for the core group.
+	kind := fmt.Sprintf("%s.%s.%s", ref.Kind, ref.Version, ref.Group)
+	infos, err := f.NewBuilder().
+		Unstructured().
+		NamespaceParam(ref.Namespace).DefaultNamespace().
+		ResourceTypeOrNameArgs(false, kind, ref.Name).
+		Flatten().
+		Do().
+		Infos()
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 1 {
+		return nil, errors.Errorf("expected one %s named %q, got %d", ref.Kind, ref.Name, len(infos))
+	}
+	obj, ok := infos[0].Object.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.Errorf("unexpected object type %T for %s %q", infos[0].Object, ref.Kind, ref.Name)
+	}
+	return obj.UnstructuredContent(), nil
+}
+
+// WaitForRollout watches a Deployment, StatefulSet or DaemonSet until its
+// rollout has completed, following the same rules as `kubectl rollout status`.
+// Other kinds return immediately.
+//
+// If the rollout does not complete within timeout, the returned error describes
+// the condition that was last unmet.
+func (f *CachedFactory) WaitForRollout(info *resource.Info, timeout time.Duration) error {
+	return waitForRollout(info, timeout)
+}
+
+func waitForRollout(info *resource.Info, timeout time.Duration) error {
+	kind := info.Mapping.GroupVersionKind.Kind
+	switch kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+	default:
+		return nil
+	}
+
+	selector, err := fields.ParseSelector(fmt.Sprintf("metadata.name=%s", info.Name))
+	if err != nil {
+		return err
+	}
+	lw := cachetools.NewListWatchFromClient(info.Client, info.Mapping.Resource.Resource, info.Namespace, selector)
+
+	ctx, cancel := watchtools.ContextWithOptionalTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status := "waiting for the rollout to be observed"
+	_, err = watchtools.UntilWithSync(ctx, lw, &unstructured.Unstructured{}, nil, func(e watch.Event) (bool, error) {
+		switch e.Type {
+		case watch.Added, watch.Modified:
+			done, msg, err := rolloutStatus(convertWithMapper(e.Object, info.Mapping))
+			status = msg
+			return done, err
+		case watch.Deleted:
+			return true, errors.Errorf("%s %q was deleted during the rollout", kind, info.Name)
+		case watch.Error:
+			return true, errors.Errorf("failed to watch the rollout of %s %q", kind, info.Name)
+		default:
+			return false, nil
+		}
+	})
+	if err != nil && ctx.Err() != nil {
+		return errors.Errorf("timed out waiting for the rollout of %s %q: %s", kind, info.Name, status)
+	}
+	return err
+}
+
+// rolloutStatus reports whether the rollout of obj has completed, and if not,
+// why. It returns an error if the rollout can never complete.
+func rolloutStatus(obj runtime.Object) (bool, string, error) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		if o.Generation > o.Status.ObservedGeneration {
+			return false, "waiting for the deployment spec update to be observed", nil
+		}
+		for _, c := range o.Status.Conditions {
+			if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+				return false, "", errors.Errorf("deployment %q exceeded its progress deadline", o.Name)
+			}
+		}
+		if o.Spec.Replicas != nil && o.Status.UpdatedReplicas < *o.Spec.Replicas {
+			return false, fmt.Sprintf("%d out of %d new replicas have been updated", o.Status.UpdatedReplicas, *o.Spec.Replicas), nil
+		}
+		if o.Status.Replicas > o.Status.UpdatedReplicas {
+			return false, fmt.Sprintf("%d old replicas are pending termination", o.Status.Replicas-o.Status.UpdatedReplicas), nil
+		}
+		if o.Status.AvailableReplicas < o.Status.UpdatedReplicas {
+			return false, fmt.Sprintf("%d of %d updated replicas are available", o.Status.AvailableReplicas, o.Status.UpdatedReplicas), nil
+		}
+		return true, "", nil
+	case *appsv1.StatefulSet:
+		if o.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+			return false, "", errors.Errorf("rollout status is only available for the %s strategy type", appsv1.RollingUpdateStatefulSetStrategyType)
+		}
+		if o.Status.ObservedGeneration == 0 || o.Generation > o.Status.ObservedGeneration {
+			return false, "waiting for the statefulset spec update to be observed", nil
+		}
+		if o.Spec.Replicas != nil && o.Status.ReadyReplicas < *o.Spec.Replicas {
+			return false, fmt.Sprintf("%d of %d pods are ready", o.Status.ReadyReplicas, *o.Spec.Replicas), nil
+		}
+		if ru := o.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && o.Spec.Replicas != nil {
+			if expected := *o.Spec.Replicas - *ru.Partition; o.Status.UpdatedReplicas < expected {
+				return false, fmt.Sprintf("%d of %d pods have been updated", o.Status.UpdatedReplicas, expected), nil
+			}
+			return true, "", nil
+		}
+		if o.Status.UpdateRevision != o.Status.CurrentRevision {
+			return false, fmt.Sprintf("%d pods at revision %s", o.Status.UpdatedReplicas, o.Status.UpdateRevision), nil
+		}
+		return true, "", nil
+	case *appsv1.DaemonSet:
+		if o.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+			return false, "", errors.Errorf("rollout status is only available for the %s strategy type", appsv1.RollingUpdateDaemonSetStrategyType)
+		}
+		if o.Generation > o.Status.ObservedGeneration {
+			return false, "waiting for the daemonset spec update to be observed", nil
+		}
+		if o.Status.UpdatedNumberScheduled < o.Status.DesiredNumberScheduled {
+			return false, fmt.Sprintf("%d out of %d new pods have been updated", o.Status.UpdatedNumberScheduled, o.Status.DesiredNumberScheduled), nil
+		}
+		if o.Status.NumberAvailable < o.Status.DesiredNumberScheduled {
+			return false, fmt.Sprintf("%d of %d updated pods are available", o.Status.NumberAvailable, o.Status.DesiredNumberScheduled), nil
+		}
+		return true, "", nil
+	default:
+		return false, "", errors.Errorf("cannot determine the rollout status of %T", obj)
+	}
+}
+
+// TailEvents streams the events recorded for the object described by info onto
+// the returned channel, starting with the first event after the call. Only
+// events that are added or updated are sent.
+//
+// The channel is closed once stop is closed, or if the API server ends the
+// watch.
+func (f *CachedFactory) TailEvents(info *resource.Info, stop <-chan struct{}) (<-chan corev1.Event, error) {
+	return tailEvents(info, stop)
+}
+
+func tailEvents(info *resource.Info, stop <-chan struct{}) (<-chan corev1.Event, error) {
+	// Events of cluster-scoped objects are recorded in the default namespace.
+	namespace := info.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	selector := fields.Set{
+		"involvedObject.kind":      info.Mapping.GroupVersionKind.Kind,
+		"involvedObject.name":      info.Name,
+		"involvedObject.namespace": info.Namespace,
+	}.AsSelector().String()
+	// info.Client is bound to the object's API group, so the path of the core
+	// events API has to be spelled out.
+	path := fmt.Sprintf("/api/v1/namespaces/%s/events", namespace)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// List first, so that the watch only delivers new events.
+	list, err := info.Client.Get().AbsPath(path).Param("fieldSelector", selector).Do(ctx).Get()
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "failed to list events for %s %q", info.Mapping.GroupVersionKind.Kind, info.Name)
+	}
+	listMeta, err := meta.ListAccessor(list)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w, err := info.Client.Get().AbsPath(path).
+		Param("fieldSelector", selector).
+		Param("resourceVersion", listMeta.GetResourceVersion()).
+		Param("watch", "true").
+		Watch(ctx)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "failed to watch events for %s %q", info.Mapping.GroupVersionKind.Kind, info.Name)
+	}
+
+	events := make(chan corev1.Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+		defer w.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case e, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				if e.Type != watch.Added && e.Type != watch.Modified {
+					continue
+				}
+				event, ok := asEvent(e.Object)
+				if !ok {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// asEvent converts an event decoded by either a typed or an unstructured
+// client.
+func asEvent(obj runtime.Object) (corev1.Event, bool) {
+	switch o := obj.(type) {
+	case *corev1.Event:
+		return *o, true
+	case *unstructured.Unstructured:
+		var event corev1.Event
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(o.Object, &event); err != nil {
+			return event, false
+		}
+		return event, true
+	default:
+		return corev1.Event{}, false
+	}
+}
+
+// KubeconfigForServiceAccount requests a token for the ServiceAccount name in
+// namespace through the TokenRequest API, and returns a kubeconfig that uses it
+// to authenticate to the cluster f is connected to, including a server set with
+// WithServerOverride.
+//
+// The token expires after the default lifetime chosen by the API server.
+func (f *CachedFactory) KubeconfigForServiceAccount(namespace, name string) ([]byte, error) {
+	// The config of the clients has no TLS settings when they retry
+	// unauthorized requests, so the one they are built from is used.
+	config, err := f.getter.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := f.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return kubeconfigForServiceAccount(client, config, namespace, name)
+}
+
+func kubeconfigForServiceAccount(client kubernetes.Interface, config *rest.Config, namespace, name string) ([]byte, error) {
+	tr, err := client.CoreV1().ServiceAccounts(namespace).CreateToken(context.Background(), name, &authenticationv1.TokenRequest{}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create a token for service account %s/%s", namespace, name)
+	}
+
+	cluster := clientcmdapi.NewCluster()
+	cluster.Server = config.Host
+	cluster.TLSServerName = config.ServerName
+	// A kubeconfig cannot both skip verification and name a certificate
+	// authority. Otherwise, the certificate authority is embedded, so that
+	// the kubeconfig can be used on its own.
+	if config.Insecure {
+		cluster.InsecureSkipTLSVerify = true
+	} else {
+		tlsConfig := rest.CopyConfig(config)
+		if err := rest.LoadTLSFiles(tlsConfig); err != nil {
+			return nil, err
+		}
+		cluster.CertificateAuthorityData = tlsConfig.CAData
+	}
+
+	user := clientcmdapi.NewAuthInfo()
+	user.Token = tr.Status.Token
+
+	kubeContext := clientcmdapi.NewContext()
+	kubeContext.Cluster = "cluster"
+	kubeContext.AuthInfo = name
+	kubeContext.Namespace = namespace
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["cluster"] = cluster
+	kubeconfig.AuthInfos[name] = user
+	kubeconfig.Contexts[name] = kubeContext
+	kubeconfig.CurrentContext = name
+	return clientcmd.Write(*kubeconfig)
+}
+
+// AcceleratorCapacity returns the total amount of the extended resource
+// resourceName, such as "nvidia.com/gpu", that the nodes of the cluster can
+// allocate to pods. It is zero when no node advertises the resource.
+func (f *CachedFactory) AcceleratorCapacity(resourceName string) (int64, error) {
+	client, err := f.KubernetesClientSet()
+	if err != nil {
+		return 0, err
+	}
+	return acceleratorCapacity(client, corev1.ResourceName(resourceName))
+}
+
+func acceleratorCapacity(client kubernetes.Interface, resourceName corev1.ResourceName) (int64, error) {
+	nodes, err := client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list nodes")
+	}
+	var total int64
+	for _, node := range nodes.Items {
+		if q, ok := node.Status.Allocatable[resourceName]; ok {
+			total += q.Value()
+		}
+	}
+	return total, nil
+}
+
+// NamespacePullSecrets returns the names of the image pull secrets of the
+// default ServiceAccount in namespace, which Kubernetes adds to every pod that
+// does not name a ServiceAccount of its own.
+func (f *CachedFactory) NamespacePullSecrets(namespace string) ([]string, error) {
+	client, err := f.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return namespacePullSecrets(client, namespace)
+}
+
+func namespacePullSecrets(client kubernetes.Interface, namespace string) ([]string, error) {
+	sa, err := client.CoreV1().ServiceAccounts(namespace).Get(context.Background(), "default", metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the default service account in %s", namespace)
+	}
+	names := make([]string, 0, len(sa.ImagePullSecrets))
+	for _, ref := range sa.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	return names, nil
+}
+
+// requiredVerbs are the verbs Helm needs on every kind of object it manages:
+// create for a new object, and get and patch or update to apply changes to an
+// existing one, including with server-side apply.
+var requiredVerbs = []string{"create", "get", "patch", "update"}
+
+// RequiredRBAC returns the RBAC policy rules an account needs to install the
+// objects in infos, one rule per API group, in the form of the rules of a Role
+// or ClusterRole. The rules are sorted by API group and list the resources of
+// each group in sorted order.
+func (f *CachedFactory) RequiredRBAC(infos []*resource.Info) ([]map[string]interface{}, error) {
+	return requiredRBAC(infos)
+}
+
+func requiredRBAC(infos []*resource.Info) ([]map[string]interface{}, error) {
+	resources := make(map[string]map[string]bool)
+	for _, info := range infos {
+		if info.Mapping == nil {
+			return nil, errors.Errorf("no resource mapping for %q", info.Name)
+		}
+		gr := info.Mapping.Resource.GroupResource()
+		if resources[gr.Group] == nil {
+			resources[gr.Group] = make(map[string]bool)
+		}
+		resources[gr.Group][gr.Resource] = true
+	}
+
+	groups := make([]string, 0, len(resources))
+	for group := range resources {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	rules := make([]map[string]interface{}, 0, len(groups))
+	for _, group := range groups {
+		names := make([]string, 0, len(resources[group]))
+		for name := range resources[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rules = append(rules, map[string]interface{}{
+			"apiGroups": []string{group},
+			"resources": names,
+			"verbs":     append([]string(nil), requiredVerbs...),
+		})
+	}
+	return rules, nil
+}
@@ -0,0 +1,1000 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/rest/fake"
+	restclientwatch "k8s.io/client-go/rest/watch"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	cmdtesting "k8s.io/kubectl/pkg/cmd/testing"
+)
+
+func TestGetMany(t *testing.T) {
+	tf := cmdtesting.NewTestFactory()
+	defer tf.Cleanup()
+
+	// Hand out a client per mapping so that concurrent requests do not share
+	// the fake's recorded state.
+	tf.UnstructuredClientForMappingFunc = func(schema.GroupVersion) (resource.RESTClient, error) {
+		return &fake.RESTClient{
+			NegotiatedSerializer: unstructuredSerializer,
+			Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+				switch p, m := req.URL.Path, req.Method; {
+				case p == "/namespaces/default/pods/starfish" && m == "GET":
+					pod := newPod("starfish")
+					return newResponse(200, &pod)
+				case p == "/namespaces/default/pods/otter" && m == "GET":
+					pod := newPod("otter")
+					return newResponse(200, &pod)
+				default:
+					return newResponse(404, notFoundBody())
+				}
+			}),
+		}, nil
+	}
+
+	podKind := v1.SchemeGroupVersion.WithKind("Pod")
+	refs := []GroupVersionKindName{
+		{GroupVersionKind: podKind, Namespace: "default", Name: "starfish"},
+		{GroupVersionKind: podKind, Namespace: "default", Name: "squid"},
+		{GroupVersionKind: podKind, Namespace: "default", Name: "otter"},
+	}
+
+	objs, errs := getMany(tf, refs)
+	if len(objs) != len(refs) || len(errs) != len(refs) {
+		t.Fatalf("expected %d results, got %d objects and %d errors", len(refs), len(objs), len(errs))
+	}
+
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Errorf("unexpected error for %s: %s", refs[i].Name, errs[i])
+			continue
+		}
+		metadata, _ := objs[i]["metadata"].(map[string]interface{})
+		if name := metadata["name"]; name != refs[i].Name {
+			t.Errorf("expected object %d to be %q, got %v", i, refs[i].Name, name)
+		}
+	}
+
+	if objs[1] != nil {
+		t.Errorf("expected no object for squid, got %v", objs[1])
+	}
+	if !apierrors.IsNotFound(errs[1]) {
+		t.Errorf("expected a not found error for squid, got %v", errs[1])
+	}
+}
+
+// fakeCachedDiscovery satisfies CachedDiscoveryInterface without caching
+// anything, so every lookup is recorded as an action on the fake.
+type fakeCachedDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d fakeCachedDiscovery) Fresh() bool { return true }
+func (d fakeCachedDiscovery) Invalidate() {}
+
+// discoveryGetter is a RESTClientGetter that only provides discovery.
+type discoveryGetter struct {
+	discovery discovery.CachedDiscoveryInterface
+}
+
+func (g discoveryGetter) ToRESTConfig() (*rest.Config, error) { return &rest.Config{}, nil }
+func (g discoveryGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	return g.discovery, nil
+}
+func (g discoveryGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	return nil, errors.New("not implemented")
+}
+func (g discoveryGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig { return nil }
+
+func TestCachedFactoryDiscovery(t *testing.T) {
+	dc := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{
+		Resources: []*metav1.APIResourceList{{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+		}},
+	}}
+	f := NewCachedFactory(discoveryGetter{discovery: fakeCachedDiscovery{dc}})
+
+	lookup := func() {
+		t.Helper()
+		mapper, err := f.ToRESTMapper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapping.Resource.Resource != "deployments" {
+			t.Fatalf("expected deployments, got %s", mapping.Resource.Resource)
+		}
+	}
+
+	if n := len(dc.Actions()); n != 0 {
+		t.Fatalf("expected no discovery requests before the first lookup, got %d", n)
+	}
+	lookup()
+	cached := len(dc.Actions())
+	if cached == 0 {
+		t.Fatal("expected the first lookup to query discovery")
+	}
+
+	for i := 0; i < 5; i++ {
+		lookup()
+	}
+	if n := len(dc.Actions()); n != cached {
+		t.Errorf("expected repeated lookups to be served from the cache, got %d discovery requests instead of %d", n, cached)
+	}
+
+	f.Invalidate()
+	lookup()
+	if n := len(dc.Actions()); n != 2*cached {
+		t.Errorf("expected an invalidated cache to query discovery again, got %d discovery requests instead of %d", n, 2*cached)
+	}
+}
+
+// flakyGetter fails to provide a discovery client the first failures times.
+type flakyGetter struct {
+	discoveryGetter
+	failures int
+}
+
+func (g *flakyGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	if g.failures > 0 {
+		g.failures--
+		return nil, errors.New("connection refused")
+	}
+	return g.discoveryGetter.ToDiscoveryClient()
+}
+
+func TestCachedFactoryDiscoveryRetry(t *testing.T) {
+	dc := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{
+		Resources: []*metav1.APIResourceList{{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+		}},
+	}}
+	getter := &flakyGetter{discoveryGetter: discoveryGetter{discovery: fakeCachedDiscovery{dc}}, failures: 1}
+	f := NewCachedFactory(getter)
+
+	if _, err := f.ToRESTMapper(); err == nil {
+		t.Fatal("expected the first lookup to fail")
+	}
+	// The failure is not cached.
+	mapper, err := f.ToRESTMapper()
+	if err != nil {
+		t.Fatalf("expected the lookup to be retried, got %s", err)
+	}
+	if _, err := mapper.RESTMapping(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once it succeeded, the client is kept.
+	getter.failures = 1
+	if _, err := f.ToDiscoveryClient(); err != nil {
+		t.Errorf("expected the cached discovery client, got %s", err)
+	}
+}
+
+func newRolloutDeployment(name string, replicas, updated, available int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Generation: 1, ResourceVersion: "1"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 1,
+			Replicas:           updated,
+			UpdatedReplicas:    updated,
+			AvailableReplicas:  available,
+		},
+	}
+}
+
+func watchBody(events ...watch.Event) io.ReadCloser {
+	buf := &bytes.Buffer{}
+	enc := restclientwatch.NewEncoder(streaming.NewEncoder(buf, codec), codec)
+	for i := range events {
+		enc.Encode(&events[i])
+	}
+	return ioutil.NopCloser(buf)
+}
+
+// newRolloutInfo returns an Info for the deployment whose list request is
+// answered with initial and whose watch stream is produced by watchStream.
+func newRolloutInfo(initial *appsv1.Deployment, watchStream func() io.ReadCloser) *resource.Info {
+	client := &fake.RESTClient{
+		GroupVersion:         appsv1.SchemeGroupVersion,
+		NegotiatedSerializer: unstructuredSerializer,
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Query().Get("watch") == "true" {
+				header := http.Header{}
+				header.Set("Content-Type", runtime.ContentTypeJSON)
+				return &http.Response{StatusCode: 200, Header: header, Body: watchStream()}, nil
+			}
+			list := &appsv1.DeploymentList{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DeploymentList"},
+				ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+				Items:    []appsv1.Deployment{*initial},
+			}
+			return newResponse(200, list)
+		}),
+	}
+	return &resource.Info{
+		Client:    client,
+		Name:      initial.Name,
+		Namespace: initial.Namespace,
+		Mapping: &meta.RESTMapping{
+			Resource:         appsv1.SchemeGroupVersion.WithResource("deployments"),
+			GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
+			Scope:            meta.RESTScopeNamespace,
+		},
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	t.Run("converging", func(t *testing.T) {
+		updating := newRolloutDeployment("starfish", 2, 1, 0)
+		done := newRolloutDeployment("starfish", 2, 2, 2)
+		done.ResourceVersion = "2"
+
+		info := newRolloutInfo(updating, func() io.ReadCloser {
+			return watchBody(watch.Event{Type: watch.Modified, Object: done})
+		})
+		if err := waitForRollout(info, 10*time.Second); err != nil {
+			t.Fatalf("expected the rollout to complete, got %s", err)
+		}
+	})
+
+	t.Run("stuck", func(t *testing.T) {
+		stuck := newRolloutDeployment("otter", 2, 2, 1)
+
+		// The watch stream stays open without ever delivering an event.
+		info := newRolloutInfo(stuck, func() io.ReadCloser {
+			r, _ := io.Pipe()
+			return r
+		})
+		err := waitForRollout(info, 100*time.Millisecond)
+		if err == nil {
+			t.Fatal("expected the rollout to time out")
+		}
+		if !strings.Contains(err.Error(), "1 of 2 updated replicas are available") {
+			t.Errorf("expected the unmet condition in the error, got %q", err)
+		}
+	})
+}
+
+func TestRolloutStatus(t *testing.T) {
+	replicas := int32(3)
+	partition := int32(1)
+
+	tests := []struct {
+		name string
+		obj  runtime.Object
+		done bool
+		msg  string
+	}{{
+		name: "deployment spec not observed",
+		obj: &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Generation: 2},
+			Status:     appsv1.DeploymentStatus{ObservedGeneration: 1},
+		},
+		msg: "waiting for the deployment spec update to be observed",
+	}, {
+		name: "deployment old replicas pending",
+		obj: &appsv1.Deployment{
+			Spec:   appsv1.DeploymentSpec{Replicas: &replicas},
+			Status: appsv1.DeploymentStatus{Replicas: 4, UpdatedReplicas: 3, AvailableReplicas: 3},
+		},
+		msg: "1 old replicas are pending termination",
+	}, {
+		name: "statefulset partitioned rollout",
+		obj: &appsv1.StatefulSet{
+			Spec: appsv1.StatefulSetSpec{
+				Replicas: &replicas,
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+					Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+					RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+				},
+			},
+			Status: appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 3, UpdatedReplicas: 2},
+		},
+		done: true,
+	}, {
+		name: "statefulset revision pending",
+		obj: &appsv1.StatefulSet{
+			Spec: appsv1.StatefulSetSpec{
+				Replicas:       &replicas,
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+			},
+			Status: appsv1.StatefulSetStatus{
+				ObservedGeneration: 1,
+				ReadyReplicas:      3,
+				UpdatedReplicas:    1,
+				CurrentRevision:    "a",
+				UpdateRevision:     "b",
+			},
+		},
+		msg: "1 pods at revision b",
+	}, {
+		name: "daemonset pods unavailable",
+		obj: &appsv1.DaemonSet{
+			Spec: appsv1.DaemonSetSpec{
+				UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType},
+			},
+			Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 2},
+		},
+		msg: "2 of 3 updated pods are available",
+	}, {
+		name: "daemonset complete",
+		obj: &appsv1.DaemonSet{
+			Spec: appsv1.DaemonSetSpec{
+				UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType},
+			},
+			Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3},
+		},
+		done: true,
+	}}
+
+	for _, tt := range tests {
+		done, msg, err := rolloutStatus(tt.obj)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if done != tt.done || msg != tt.msg {
+			t.Errorf("%s: expected (%v, %q), got (%v, %q)", tt.name, tt.done, tt.msg, done, msg)
+		}
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "squid"},
+		Status: appsv1.DeploymentStatus{Conditions: []appsv1.DeploymentCondition{{
+			Type:   appsv1.DeploymentProgressing,
+			Reason: "ProgressDeadlineExceeded",
+		}}},
+	}
+	if _, _, err := rolloutStatus(deployment); err == nil {
+		t.Error("expected an error for a deployment past its progress deadline")
+	}
+}
+
+func TestKubeconfigForServiceAccount(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" || action.GetNamespace() != "ci" {
+			return false, nil, nil
+		}
+		return true, &authenticationv1.TokenRequest{
+			Status: authenticationv1.TokenRequestStatus{Token: "s3cr3t"},
+		}, nil
+	})
+	config := &rest.Config{
+		Host:            "https://k8s.example.com:6443",
+		TLSClientConfig: rest.TLSClientConfig{CAData: []byte("certificate authority")},
+	}
+
+	data, err := kubeconfigForServiceAccount(client, config, "ci", "deployer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatalf("expected a valid kubeconfig, got %s", err)
+	}
+
+	kubeContext := kubeconfig.Contexts[kubeconfig.CurrentContext]
+	if kubeContext == nil || kubeContext.Namespace != "ci" {
+		t.Fatalf("expected the current context to use the ci namespace, got %+v", kubeContext)
+	}
+	if token := kubeconfig.AuthInfos[kubeContext.AuthInfo].Token; token != "s3cr3t" {
+		t.Errorf("expected token s3cr3t, got %q", token)
+	}
+	cluster := kubeconfig.Clusters[kubeContext.Cluster]
+	if cluster.Server != config.Host {
+		t.Errorf("expected server %s, got %s", config.Host, cluster.Server)
+	}
+	if string(cluster.CertificateAuthorityData) != "certificate authority" {
+		t.Errorf("expected the certificate authority to be embedded, got %q", cluster.CertificateAuthorityData)
+	}
+
+	if _, err := kubeconfigForServiceAccount(client, config, "default", "deployer"); err == nil {
+		t.Error("expected an error when the token request fails")
+	}
+
+	// The kubeconfig points at the server the factory connects to, and
+	// skips verification like the kubeconfig of the factory does, even when
+	// its clients retry unauthorized requests.
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != "/api/v1/namespaces/ci/serviceaccounts/deployer/token" {
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+		}
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		fmt.Fprint(w, `{"apiVersion": "authentication.k8s.io/v1", "kind": "TokenRequest", "status": {"token": "t0ken"}}`)
+	}))
+	defer proxy.Close()
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, "https://unused.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = f.WithServerOverride(proxy.URL).WithCredentialRefresh(nil).KubeconfigForServiceAccount("ci", "deployer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kubeconfig, err = clientcmd.Load(data); err != nil {
+		t.Fatalf("expected a valid kubeconfig, got %s", err)
+	}
+	cluster = kubeconfig.Clusters[kubeconfig.Contexts[kubeconfig.CurrentContext].Cluster]
+	if cluster.Server != proxy.URL {
+		t.Errorf("expected server %s, got %s", proxy.URL, cluster.Server)
+	}
+	if !cluster.InsecureSkipTLSVerify || len(cluster.CertificateAuthorityData) != 0 {
+		t.Errorf("expected only insecure-skip-tls-verify to be set, got %v and %q", cluster.InsecureSkipTLSVerify, cluster.CertificateAuthorityData)
+	}
+}
+
+func TestTailEvents(t *testing.T) {
+	newEvent := func(name, reason string) *v1.Event {
+		return &v1.Event{
+			TypeMeta:       metav1.TypeMeta{APIVersion: "v1", Kind: "Event"},
+			ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: "2"},
+			InvolvedObject: v1.ObjectReference{Kind: "Deployment", Name: "starfish", Namespace: "default"},
+			Reason:         reason,
+		}
+	}
+
+	watching := make(chan string, 1)
+	client := &fake.RESTClient{
+		GroupVersion:         appsv1.SchemeGroupVersion,
+		NegotiatedSerializer: unstructuredSerializer,
+		Client: fake.CreateHTTPClient(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "/api/v1/namespaces/default/events" {
+				t.Errorf("unexpected request to %s", req.URL.Path)
+				return newResponse(404, notFoundBody())
+			}
+			if req.URL.Query().Get("watch") != "true" {
+				list := &v1.EventList{
+					TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "EventList"},
+					ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+					Items:    []v1.Event{*newEvent("old", "Scheduled")},
+				}
+				return newResponse(200, list)
+			}
+			watching <- req.URL.Query().Get("resourceVersion")
+			header := http.Header{}
+			header.Set("Content-Type", runtime.ContentTypeJSON)
+			// Keep the stream open after the two events, as the API server
+			// would, until the test stops tailing.
+			r, w := io.Pipe()
+			go func() {
+				io.Copy(w, watchBody(
+					watch.Event{Type: watch.Added, Object: newEvent("first", "FailedScheduling")},
+					watch.Event{Type: watch.Modified, Object: newEvent("first", "FailedScheduling")},
+				))
+			}()
+			return &http.Response{StatusCode: 200, Header: header, Body: r}, nil
+		}),
+	}
+	info := &resource.Info{
+		Client:    client,
+		Name:      "starfish",
+		Namespace: "default",
+		Mapping: &meta.RESTMapping{
+			Resource:         appsv1.SchemeGroupVersion.WithResource("deployments"),
+			GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
+			Scope:            meta.RESTScopeNamespace,
+		},
+	}
+
+	stop := make(chan struct{})
+	events, err := tailEvents(info, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv := <-watching; rv != "1" {
+		t.Errorf("expected the watch to start after the listed events, got resource version %q", rv)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Name != "first" || e.Reason != "FailedScheduling" {
+				t.Errorf("unexpected event %s: %s", e.Name, e.Reason)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected no more events after stop")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the channel to be closed after stop")
+	}
+}
+
+func TestAcceleratorCapacity(t *testing.T) {
+	node := func(name string, allocatable v1.ResourceList) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Allocatable: allocatable},
+		}
+	}
+	client := k8sfake.NewSimpleClientset(
+		node("gpu-a", v1.ResourceList{"nvidia.com/gpu": apiresource.MustParse("4"), v1.ResourceCPU: apiresource.MustParse("32")}),
+		node("gpu-b", v1.ResourceList{"nvidia.com/gpu": apiresource.MustParse("2")}),
+		node("cpu", v1.ResourceList{v1.ResourceCPU: apiresource.MustParse("8")}),
+	)
+
+	total, err := acceleratorCapacity(client, "nvidia.com/gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 6 {
+		t.Errorf("expected 6 GPUs, got %d", total)
+	}
+
+	total, err = acceleratorCapacity(client, "amd.com/gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("expected no AMD GPUs, got %d", total)
+	}
+}
+
+func TestNamespacePullSecrets(t *testing.T) {
+	client := k8sfake.NewSimpleClientset(&v1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "apps"},
+		ImagePullSecrets: []v1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}},
+	}, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "empty"},
+	})
+
+	secrets, err := namespacePullSecrets(client, "apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets[0] != "registry" || secrets[1] != "mirror" {
+		t.Errorf("expected [registry mirror], got %v", secrets)
+	}
+
+	secrets, err = namespacePullSecrets(client, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 0 {
+		t.Errorf("expected no pull secrets, got %v", secrets)
+	}
+
+	if _, err := namespacePullSecrets(client, "missing"); err == nil {
+		t.Error("expected an error for a namespace without a default service account")
+	}
+}
+
+func TestRequiredRBAC(t *testing.T) {
+	info := func(gvr schema.GroupVersionResource, name string) *resource.Info {
+		return &resource.Info{Name: name, Mapping: &meta.RESTMapping{Resource: gvr}}
+	}
+	infos := []*resource.Info{
+		info(appsv1.SchemeGroupVersion.WithResource("deployments"), "web"),
+		info(v1.SchemeGroupVersion.WithResource("services"), "web"),
+		info(v1.SchemeGroupVersion.WithResource("configmaps"), "web-config"),
+		info(appsv1.SchemeGroupVersion.WithResource("deployments"), "worker"),
+	}
+
+	rules, err := requiredRBAC(infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verbs := []string{"create", "get", "patch", "update"}
+	expect := []map[string]interface{}{
+		{"apiGroups": []string{""}, "resources": []string{"configmaps", "services"}, "verbs": verbs},
+		{"apiGroups": []string{"apps"}, "resources": []string{"deployments"}, "verbs": verbs},
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("expected %v, got %v", expect, rules)
+	}
+}
+
+const kubeconfigFixture = `apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    namespace: fixtures
+    user: fake
+current-context: fake
+users:
+- name: fake
+  user:
+    token: s3cr3t
+`
+
+func TestNewCachedFactoryFromKubeconfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if auth := req.Header.Get("Authorization"); auth != "Bearer s3cr3t" {
+			t.Errorf("expected the token from the kubeconfig, got %q", auth)
+		}
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		switch req.URL.Path {
+		case "/version":
+			fmt.Fprint(w, `{"major": "1", "minor": "24", "gitVersion": "v1.24.2"}`)
+		case "/api/v1/namespaces/fixtures/configmaps":
+			fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMapList", "items": [{"metadata": {"name": "starfish"}}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, _, err := f.ToRawKubeConfigLoader().Namespace(); err != nil || ns != "fixtures" {
+		t.Errorf("expected namespace fixtures, got %q (%v)", ns, err)
+	}
+
+	clientset, err := f.KubernetesClientSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.GitVersion != "v1.24.2" {
+		t.Errorf("expected version v1.24.2, got %s", version.GitVersion)
+	}
+
+	dynamicClient, err := f.DynamicClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := dynamicClient.Resource(v1.SchemeGroupVersion.WithResource("configmaps")).Namespace("fixtures").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "starfish" {
+		t.Errorf("expected the starfish config map, got %v", list.Items)
+	}
+
+	if _, err := NewCachedFactoryFromKubeconfig([]byte("clusters: [")); err == nil {
+		t.Error("expected an error for a malformed kubeconfig")
+	}
+}
+
+type warningRecorder []string
+
+func (w *warningRecorder) HandleWarningHeader(code int, agent string, text string) {
+	*w = append(*w, text)
+}
+
+func TestCachedFactoryWithWarningHandler(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		w.Header().Add("Warning", `299 - "policy/v1beta1 PodDisruptionBudget is deprecated"`)
+		fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMapList", "items": []}`)
+	}))
+	defer server.Close()
+
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings warningRecorder
+	clientset, err := f.WithWarningHandler(&warnings).KubernetesClientSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("fixtures").List(context.Background(), metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) != 1 || warnings[0] != "policy/v1beta1 PodDisruptionBudget is deprecated" {
+		t.Errorf("expected the deprecation warning, got %q", warnings)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCachedFactoryWithTransportWrapper(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if proxy := req.Header.Get("X-Egress-Token"); proxy != "t0k3n" {
+			t.Errorf("expected the header set by the wrapper, got %q", proxy)
+		}
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMapList", "items": []}`)
+	}))
+	defer server.Close()
+
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	f.WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Egress-Token", "t0k3n")
+			return rt.RoundTrip(req)
+		})
+	})
+
+	clientset, err := f.KubernetesClientSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("fixtures").List(context.Background(), metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := f.DynamicClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dynamicClient.Resource(v1.SchemeGroupVersion.WithResource("configmaps")).Namespace("fixtures").List(context.Background(), metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected the wrapper to be called for both clients, got %d calls", calls)
+	}
+}
+
+func TestCachedFactoryPing(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		body   string
+		expect error
+	}{
+		{"reachable", http.StatusOK, `{"major": "1", "minor": "24", "gitVersion": "v1.24.2"}`, nil},
+		{"expired token", http.StatusUnauthorized, `{"apiVersion": "v1", "kind": "Status", "status": "Failure", "reason": "Unauthorized", "code": 401}`, ErrUnauthorized},
+		{"rbac denial", http.StatusForbidden, `{"apiVersion": "v1", "kind": "Status", "status": "Failure", "reason": "Forbidden", "code": 403}`, ErrForbidden},
+		{"not an api server", http.StatusBadGateway, `bad gateway`, ErrClusterUnreachable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/version" {
+					t.Errorf("expected a request for /version, got %s", req.URL.Path)
+				}
+				w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Ping(context.Background())
+			if tt.expect == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if tt.expect != nil && !errors.Is(err, tt.expect) {
+				t.Errorf("expected %v, got %v", tt.expect, err)
+			}
+		})
+	}
+
+	t.Run("network failure", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		server.Close()
+
+		f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Ping(context.Background()); !errors.Is(err, ErrClusterUnreachable) {
+			t.Errorf("expected %v, got %v", ErrClusterUnreachable, err)
+		}
+	})
+}
+
+func TestCachedFactoryWithCredentialRefresh(t *testing.T) {
+	// The server rejects the first unauthorized requests it receives.
+	var requests, unauthorized int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if auth := req.Header.Get("Authorization"); auth != "Bearer s3cr3t" {
+			t.Errorf("expected the token from the kubeconfig, got %q", auth)
+		}
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		if requests <= unauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"apiVersion": "v1", "kind": "Status", "status": "Failure", "reason": "Unauthorized", "code": 401}`)
+			return
+		}
+		if body, _ := ioutil.ReadAll(req.Body); !strings.Contains(string(body), "starfish") {
+			t.Errorf("expected the body to be sent again, got %q", body)
+		}
+		fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "starfish"}}`)
+	}))
+	defer server.Close()
+
+	createConfigMap := func(refresh func(context.Context) error) error {
+		f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientset, err := f.WithCredentialRefresh(refresh).KubernetesClientSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "starfish"}}
+		_, err = clientset.CoreV1().ConfigMaps("fixtures").Create(context.Background(), cm, metav1.CreateOptions{})
+		return err
+	}
+
+	// A 401 is followed by a refresh and a single retry.
+	requests, unauthorized = 0, 1
+	var refreshes int
+	err := createConfigMap(func(ctx context.Context) error {
+		refreshes++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || refreshes != 1 {
+		t.Errorf("expected a single refresh and retry, got %d requests and %d refreshes", requests, refreshes)
+	}
+
+	// A second 401 is returned rather than retried again.
+	requests, unauthorized = 0, 2
+	if err := createConfigMap(nil); err == nil {
+		t.Error("expected the second 401 to be returned")
+	}
+	if requests != 2 {
+		t.Errorf("expected a single retry, got %d requests", requests)
+	}
+
+	// If the refresh fails, the request is not retried.
+	requests, unauthorized = 0, 1
+	err = createConfigMap(func(ctx context.Context) error {
+		return errors.New("token endpoint unavailable")
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to refresh credentials: token endpoint unavailable") {
+		t.Errorf("expected the refresh error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected no retry, got %d requests", requests)
+	}
+
+	// The clients of a factory share a single transport.
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WithCredentialRefresh(nil)
+	first, err := f.ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := f.ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Transport == nil || first.Transport != second.Transport {
+		t.Error("expected the configs to share the retrying transport")
+	}
+}
+
+func TestCachedFactoryWithServerOverride(t *testing.T) {
+	original := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("expected no requests to the server in the kubeconfig, got %s", req.URL.Path)
+	}))
+	defer original.Close()
+	var paths []string
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		if auth := req.Header.Get("Authorization"); auth != "Bearer s3cr3t" {
+			t.Errorf("expected the token from the kubeconfig, got %q", auth)
+		}
+		w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+		switch req.URL.Path {
+		case "/version":
+			fmt.Fprint(w, `{"major": "1", "minor": "24", "gitVersion": "v1.24.2"}`)
+		default:
+			fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMapList", "items": []}`)
+		}
+	}))
+	defer proxy.Close()
+
+	f, err := NewCachedFactoryFromKubeconfig([]byte(fmt.Sprintf(kubeconfigFixture, original.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WithServerOverride(proxy.URL)
+
+	config, err := f.ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != proxy.URL {
+		t.Errorf("expected host %s, got %s", proxy.URL, config.Host)
+	}
+	if config.BearerToken != "s3cr3t" || !config.Insecure {
+		t.Errorf("expected the credentials and TLS settings of the kubeconfig, got token %q and insecure %v", config.BearerToken, config.Insecure)
+	}
+
+	clientset, err := f.KubernetesClientSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("fixtures").List(context.Background(), metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dc, err := f.ToDiscoveryClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.ServerVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"/api/v1/namespaces/fixtures/configmaps", "/version"}) {
+		t.Errorf("expected the requests to go to the proxy, got %v", paths)
+	}
+}